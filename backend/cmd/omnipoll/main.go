@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
@@ -12,10 +14,22 @@ import (
 	"github.com/omnipoll/backend/internal/admin"
 	"github.com/omnipoll/backend/internal/config"
 	"github.com/omnipoll/backend/internal/poller"
+	"github.com/omnipoll/backend/internal/telemetry"
 )
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	// Maintenance commands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rotate-keys":
+			os.Exit(runRotateKeys())
+		default:
+			log.Fatalf("Unknown command %q (available: rotate-keys)", os.Args[1])
+		}
+	}
+
 	log.Println("Starting Omnipoll...")
 
 	// Initialize configuration manager
@@ -26,12 +40,32 @@ func main() {
 
 	// Load configuration
 	if err := cfgManager.Load(); err != nil {
-		log.Printf("Warning: Could not load config file, using defaults: %v", err)
+		var invalid config.ValidationErrors
+		if errors.As(err, &invalid) {
+			for _, fe := range invalid {
+				log.Printf("Invalid config: %s: %s", fe.Field, fe.Message)
+			}
+			log.Fatalf("Refusing to start with an invalid configuration (%s)", cfgManager.GetPath())
+		}
+		// Unresolvable secret references, unknown key IDs and unreadable
+		// files must not fall back to the default credentials
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Fatalf("Failed to load config %s: %v", cfgManager.GetPath(), err)
+		}
+		log.Printf("Warning: Config file not found, using defaults: %v", err)
 	}
 
 	cfg := cfgManager.Get()
 	log.Printf("Configuration loaded from: %s", cfgManager.GetPath())
 
+	// Initialize tracing (no-op unless enabled in config)
+	shutdownTracing, err := telemetry.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		log.Printf("Warning: Could not initialize tracing: %v", err)
+	} else if cfg.Tracing.Enabled {
+		log.Printf("Tracing enabled (exporter: %s)", cfg.Tracing.Exporter)
+	}
+
 	// Initialize worker
 	worker := poller.NewWorker(cfgManager)
 
@@ -74,12 +108,17 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
+	// Stop admin server first, so its audit entries reach MongoDB
+	if err := adminServer.Stop(ctx); err != nil {
+		log.Printf("Error stopping admin server: %v", err)
+	}
+
 	// Stop worker
 	worker.Shutdown(ctx)
 
-	// Stop admin server
-	if err := adminServer.Stop(ctx); err != nil {
-		log.Printf("Error stopping admin server: %v", err)
+	// Flush pending spans
+	if err := shutdownTracing(ctx); err != nil {
+		log.Printf("Error flushing traces: %v", err)
 	}
 
 	log.Println("Omnipoll shutdown complete")
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/omnipoll/backend/internal/config"
+	"github.com/omnipoll/backend/internal/crypto"
+)
+
+// runRotateKeys re-encrypts all config secrets, including those of saved
+// config versions, with the current master key.
+//
+// Usage:
+//
+//	OMNIPOLL_MASTER_KEY=<new> OMNIPOLL_PREVIOUS_MASTER_KEYS=<old> omnipoll rotate-keys
+func runRotateKeys() int {
+	if os.Getenv(crypto.MasterKeyEnv) == "" {
+		log.Printf("%s must be set to the new key", crypto.MasterKeyEnv)
+		return 1
+	}
+
+	cfgManager, err := config.NewManager()
+	if err != nil {
+		log.Printf("Failed to create config manager: %v", err)
+		return 1
+	}
+
+	rotated, err := cfgManager.RotateKeys()
+	if err != nil {
+		log.Printf("Key rotation failed: %v", err)
+		return 1
+	}
+
+	log.Printf("Re-encrypted %d secret(s) in %s and its saved versions with key %s", rotated, cfgManager.GetPath(), cfgManager.ActiveKeyID())
+	log.Printf("Once every instance uses the new key, remove the old one from %s", crypto.PreviousMasterKeysEnv)
+	return 0
+}
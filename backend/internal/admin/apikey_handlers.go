@@ -0,0 +1,137 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/omnipoll/backend/internal/apikeys"
+)
+
+// APIKeyResponse is an API key as returned by the API (never includes the hash)
+type APIKeyResponse struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"createdAt"`
+	CreatedBy  string   `json:"createdBy"`
+	LastUsedAt string   `json:"lastUsedAt,omitempty"`
+	RevokedAt  string   `json:"revokedAt,omitempty"`
+	Active     bool     `json:"active"`
+	Key        string   `json:"key,omitempty"` // Only set once, on creation
+}
+
+func toAPIKeyResponse(k apikeys.Key) APIKeyResponse {
+	resp := APIKeyResponse{
+		ID:        k.ID,
+		Name:      k.Name,
+		Scopes:    k.Scopes,
+		CreatedAt: k.CreatedAt.Format(time.RFC3339),
+		CreatedBy: k.CreatedBy,
+		Active:    k.Active(),
+	}
+	if k.LastUsedAt != nil {
+		resp.LastUsedAt = k.LastUsedAt.Format(time.RFC3339)
+	}
+	if k.RevokedAt != nil {
+		resp.RevokedAt = k.RevokedAt.Format(time.RFC3339)
+	}
+	return resp
+}
+
+// handleAPIKeys lists (GET) or creates (POST) API keys
+func (s *Server) handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		keys := s.apiKeys.List()
+		resp := make([]APIKeyResponse, 0, len(keys))
+		for _, k := range keys {
+			resp = append(resp, toAPIKeyResponse(k))
+		}
+		WriteSuccess(w, http.StatusOK, resp)
+
+	case http.MethodPost:
+		var req struct {
+			Name   string   `json:"name"`
+			Scopes []string `json:"scopes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			WriteError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" {
+			WriteError(w, http.StatusBadRequest, "name is required")
+			return
+		}
+		if len(req.Scopes) == 0 {
+			WriteError(w, http.StatusBadRequest, "at least one scope is required")
+			return
+		}
+		for _, scope := range req.Scopes {
+			if !ValidPermission(scope) {
+				WriteError(w, http.StatusBadRequest, "Unknown scope: "+scope)
+				return
+			}
+			// Keys must not be able to mint more keys
+			if Permission(scope) == PermAPIKeysManage {
+				WriteError(w, http.StatusBadRequest, "Scope "+scope+" cannot be granted to an API key")
+				return
+			}
+		}
+
+		createdBy := ""
+		if p := PrincipalFrom(r.Context()); p != nil {
+			createdBy = p.Name
+		}
+
+		key, plain, err := s.apiKeys.Create(req.Name, req.Scopes, createdBy)
+		if err != nil {
+			log.Printf("Error creating API key: %v", err)
+			WriteError(w, http.StatusInternalServerError, "Failed to create API key: "+err.Error())
+			return
+		}
+		log.Printf("[auth] API key %q (%s) created by %s with scopes %v", key.Name, key.ID, createdBy, key.Scopes)
+
+		s.audit(r, auditRecord{Action: "apikey.create", Target: "apikey:" + key.ID, After: toAPIKeyResponse(key)})
+
+		resp := toAPIKeyResponse(key)
+		resp.Key = plain
+		WriteSuccess(w, http.StatusCreated, resp)
+
+	default:
+		WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// handleAPIKeyByID revokes (DELETE) a single API key
+func (s *Server) handleAPIKeyByID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/apikeys/")
+	if id == "" || strings.Contains(id, "/") {
+		WriteError(w, http.StatusBadRequest, "Invalid API key ID")
+		return
+	}
+
+	key, err := s.apiKeys.Revoke(id)
+	if errors.Is(err, apikeys.ErrNotFound) {
+		WriteError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, "Failed to revoke API key: "+err.Error())
+		return
+	}
+	log.Printf("[auth] API key %q (%s) revoked", key.Name, key.ID)
+	s.audit(r, auditRecord{Action: "apikey.revoke", Target: "apikey:" + key.ID})
+
+	WriteSuccess(w, http.StatusOK, toAPIKeyResponse(key))
+}
@@ -0,0 +1,447 @@
+package admin
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omnipoll/backend/internal/apikeys"
+	"github.com/omnipoll/backend/internal/config"
+	"github.com/omnipoll/backend/internal/crypto"
+)
+
+const sessionCookieName = "omnipoll_session"
+
+var errUnauthorized = errors.New("unauthorized")
+
+// lockedError is returned while an account or client is locked out
+type lockedError struct {
+	retryAfter time.Duration
+}
+
+func (e *lockedError) Error() string {
+	return fmt.Sprintf("too many failed logins, retry in %s", e.retryAfter.Round(time.Second))
+}
+
+// session is a logged-in admin user
+type session struct {
+	username string
+	expires  time.Time
+}
+
+// sessionStore issues and verifies HMAC-signed session tokens. Sessions
+// are kept server-side so logout revokes them immediately; they do not
+// survive a restart.
+type sessionStore struct {
+	mu          sync.Mutex
+	key         []byte
+	sessions    map[string]session
+	verified    map[string]time.Time // Basic auth cache: HMAC of credentials -> expiry
+	verifiedFor string               // HMAC of the admin config the cache was filled under
+}
+
+func newSessionStore() *sessionStore {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic("admin: cannot generate session key: " + err.Error())
+	}
+	return &sessionStore{
+		key:      key,
+		sessions: make(map[string]session),
+		verified: make(map[string]time.Time),
+	}
+}
+
+// create starts a session and returns its token
+func (s *sessionStore) create(username string, ttl time.Duration) (string, time.Time, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, err
+	}
+	id := base64.RawURLEncoding.EncodeToString(raw)
+	expires := time.Now().Add(ttl)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Drop expired sessions while we hold the lock
+	now := time.Now()
+	for k, sess := range s.sessions {
+		if now.After(sess.expires) {
+			delete(s.sessions, k)
+		}
+	}
+	s.sessions[id] = session{username: username, expires: expires}
+
+	return id + "." + s.sign(id), expires, nil
+}
+
+// lookup verifies a token and returns its live session
+func (s *sessionStore) lookup(token string) (session, bool) {
+	id, ok := s.verify(token)
+	if !ok {
+		return session{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[id]
+	if !ok {
+		return session{}, false
+	}
+	if time.Now().After(sess.expires) {
+		delete(s.sessions, id)
+		return session{}, false
+	}
+	return sess, true
+}
+
+// revoke ends the session identified by token
+func (s *sessionStore) revoke(token string) {
+	id, ok := s.verify(token)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	delete(s.sessions, id)
+	s.mu.Unlock()
+}
+
+func (s *sessionStore) sign(id string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks the token signature and returns the session ID
+func (s *sessionStore) verify(token string) (string, bool) {
+	id, sig, ok := strings.Cut(token, ".")
+	if !ok || id == "" {
+		return "", false
+	}
+	if !hmac.Equal([]byte(sig), []byte(s.sign(id))) {
+		return "", false
+	}
+	return id, true
+}
+
+// basicAuthCacheTTL is how long verified basic auth credentials are
+// remembered, so polling clients don't pay a bcrypt comparison per request
+const basicAuthCacheTTL = time.Minute
+
+// rememberBasic records verified credentials under an HMAC of the pair
+func (s *sessionStore) rememberBasic(admin config.AdminConfig, username, password string) {
+	key := s.sign("basic:" + username + ":" + password)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.syncBasicCache(admin)
+	now := time.Now()
+	for k, expires := range s.verified {
+		if now.After(expires) {
+			delete(s.verified, k)
+		}
+	}
+	s.verified[key] = now.Add(basicAuthCacheTTL)
+}
+
+// recallBasic reports whether the credentials were verified recently
+func (s *sessionStore) recallBasic(admin config.AdminConfig, username, password string) bool {
+	key := s.sign("basic:" + username + ":" + password)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.syncBasicCache(admin)
+	expires, ok := s.verified[key]
+	return ok && time.Now().Before(expires)
+}
+
+// syncBasicCache clears the basic auth cache when the admin
+// config differs from the one it was filled under, so a changed or
+// removed password stops working at once. The caller holds s.mu.
+func (s *sessionStore) syncBasicCache(admin config.AdminConfig) {
+	data, err := json.Marshal(admin)
+	if err != nil {
+		s.verified = make(map[string]time.Time)
+		return
+	}
+	if fingerprint := s.sign(string(data)); fingerprint != s.verifiedFor {
+		s.verified = make(map[string]time.Time)
+		s.verifiedFor = fingerprint
+	}
+}
+
+// loginLimiter counts failed logins per key and locks the key out once
+// the limit is reached
+type loginLimiter struct {
+	mu       sync.Mutex
+	attempts map[string]*loginAttempts
+}
+
+type loginAttempts struct {
+	failures    int
+	lockedUntil time.Time
+	lastFailure time.Time
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{attempts: make(map[string]*loginAttempts)}
+}
+
+// locked returns how long the key remains locked out
+func (l *loginLimiter) locked(key string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	a, ok := l.attempts[key]
+	if !ok {
+		return 0, false
+	}
+	if remaining := time.Until(a.lockedUntil); remaining > 0 {
+		return remaining, true
+	}
+	return 0, false
+}
+
+// fail records a failed attempt; the counter resets after a quiet lockout period
+func (l *loginLimiter) fail(key string, maxAttempts int, lockout time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for k, a := range l.attempts {
+		if now.Sub(a.lastFailure) > lockout && now.After(a.lockedUntil) {
+			delete(l.attempts, k)
+		}
+	}
+
+	a, ok := l.attempts[key]
+	if !ok {
+		a = &loginAttempts{}
+		l.attempts[key] = a
+	}
+	a.failures++
+	a.lastFailure = now
+	if a.failures >= maxAttempts {
+		a.lockedUntil = now.Add(lockout)
+		a.failures = 0
+		log.Printf("[auth] Locked out %s for %s after %d failed logins", key, lockout, maxAttempts)
+	}
+}
+
+// reset clears the failure count after a successful login
+func (l *loginLimiter) reset(key string) {
+	l.mu.Lock()
+	delete(l.attempts, key)
+	l.mu.Unlock()
+}
+
+// clientFailureFactor is how many more failures a client address may
+// have, across all usernames, than a single account from that address
+const clientFailureFactor = 4
+
+// limiterKeys returns the lockout keys for a login attempt: the account
+// from this client address, and the client address as a whole. Accounts
+// are not locked for every address, or anyone could lock out the admin.
+func limiterKeys(r *http.Request, username string) []string {
+	ip := clientIP(r)
+	return []string{"user:" + username + "@" + ip, "ip:" + ip}
+}
+
+// clientIP returns the remote address without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// login checks credentials with lockout bookkeeping
+func (s *Server) login(r *http.Request, username, password string) (*Principal, error) {
+	cfg := s.configManager.Get().Admin
+	keys := limiterKeys(r, username)
+
+	for _, key := range keys {
+		if remaining, locked := s.logins.locked(key); locked {
+			return nil, &lockedError{retryAfter: remaining}
+		}
+	}
+
+	principal, ok := s.verifyCredentials(username, password)
+	if !ok {
+		maxAttempts := cfg.MaxLoginAttempts
+		if maxAttempts <= 0 {
+			maxAttempts = 5
+		}
+		lockout := time.Duration(cfg.LockoutMinutes) * time.Minute
+		if lockout <= 0 {
+			lockout = 15 * time.Minute
+		}
+		s.logins.fail(keys[0], maxAttempts, lockout)
+		s.logins.fail(keys[1], maxAttempts*clientFailureFactor, lockout)
+		return nil, errUnauthorized
+	}
+
+	for _, key := range keys {
+		s.logins.reset(key)
+	}
+	return principal, nil
+}
+
+// verifyCredentials checks a username and password against the configured accounts
+func (s *Server) verifyCredentials(username, password string) (*Principal, bool) {
+	cfg := s.configManager.Get().Admin
+
+	// Legacy single account
+	if cfg.Username != "" && username == cfg.Username {
+		if crypto.CheckPassword(cfg.Password, password) {
+			return NewPrincipal(username, RoleAdmin), true
+		}
+		return nil, false
+	}
+
+	for _, u := range cfg.Users {
+		if u.Username == username {
+			if crypto.CheckPassword(u.Password, password) {
+				return NewPrincipal(u.Username, Role(u.Role)), true
+			}
+			return nil, false
+		}
+	}
+
+	crypto.BurnPasswordCheck(password)
+	return nil, false
+}
+
+// principalForUser resolves a session's username to its current role, so
+// role changes and removed accounts take effect on the next request
+func (s *Server) principalForUser(username string) (*Principal, bool) {
+	cfg := s.configManager.Get().Admin
+	if cfg.Username != "" && username == cfg.Username {
+		return NewPrincipal(username, RoleAdmin), true
+	}
+	for _, u := range cfg.Users {
+		if u.Username == username {
+			return NewPrincipal(u.Username, Role(u.Role)), true
+		}
+	}
+	return nil, false
+}
+
+// apiKeyFromRequest extracts an API key from X-API-Key or a Bearer header
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer "+apikeys.KeyPrefix) {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// sessionToken extracts a session token from the Bearer header or cookie
+func sessionToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") && !apikeys.IsAPIKey(strings.TrimPrefix(auth, "Bearer ")) {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// handleLogin exchanges a username and password for a session token
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	principal, err := s.login(r, req.Username, req.Password)
+	if err != nil {
+		var locked *lockedError
+		if errors.As(err, &locked) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(locked.retryAfter.Seconds())+1))
+			WriteError(w, http.StatusTooManyRequests, locked.Error())
+			return
+		}
+		log.Printf("[auth] Failed login for %q from %s", req.Username, clientIP(r))
+		s.auditAs(req.Username, clientIP(r), auditRecord{Action: "auth.login_failed", Target: "user:" + req.Username})
+		WriteError(w, http.StatusUnauthorized, "Invalid username or password")
+		return
+	}
+
+	ttl := time.Duration(s.configManager.Get().Admin.SessionTTLMinutes) * time.Minute
+	if ttl <= 0 {
+		ttl = 8 * time.Hour
+	}
+	token, expires, err := s.sessions.create(principal.Name, ttl)
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, "Failed to create session")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	log.Printf("[auth] %s logged in from %s", principal.Name, clientIP(r))
+	s.auditAs(principal.Name, clientIP(r), auditRecord{Action: "auth.login", Target: "user:" + principal.Name})
+	WriteSuccess(w, http.StatusOK, map[string]interface{}{
+		"token":     token,
+		"expiresAt": expires.UTC().Format(time.RFC3339),
+		"user":      principal,
+	})
+}
+
+// handleLogout revokes the caller's session
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if token := sessionToken(r); token != "" {
+		s.sessions.revoke(token)
+	}
+	s.audit(r, auditRecord{Action: "auth.logout", Target: "session"})
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	WriteSuccess(w, http.StatusOK, map[string]string{"message": "Logged out"})
+}
@@ -0,0 +1,132 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/omnipoll/backend/internal/config"
+	"github.com/omnipoll/backend/internal/mongo"
+)
+
+// ConfigImportRequest is the body of POST /api/config/import
+type ConfigImportRequest struct {
+	Bundle  json.RawMessage   `json:"bundle"`
+	Secrets map[string]string `json:"secrets"` // Placeholder values by field, e.g. "mqtt.password"
+	DryRun  bool              `json:"dryRun"`
+}
+
+// ConfigImportResponse previews (or reports) the effect of an import
+type ConfigImportResponse struct {
+	Valid         bool                       `json:"valid"`
+	Applied       bool                       `json:"applied"`
+	SchemaVersion int                        `json:"schemaVersion"`
+	Errors        []config.FieldError        `json:"errors"`
+	Changes       []mongo.FieldChange        `json:"changes"`
+	Placeholders  []config.PlaceholderStatus `json:"placeholders"`
+}
+
+// handleConfigExport downloads the configuration as a bundle without secrets
+func (s *Server) handleConfigExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	bundle := s.configManager.ExportBundle(actorName(r))
+	filename := fmt.Sprintf("omnipoll-config-%s.json", bundle.ExportedAt.Format("20060102-150405"))
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	s.audit(r, auditRecord{Action: "config.export", Target: "config"})
+	WriteJSON(w, http.StatusOK, bundle)
+}
+
+// handleConfigImport previews (dryRun) or applies a config bundle
+func (s *Server) handleConfigImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req ConfigImportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+		return
+	}
+	if len(req.Bundle) == 0 {
+		WriteError(w, http.StatusBadRequest, "bundle is required")
+		return
+	}
+	if r.URL.Query().Get("dryRun") == "true" {
+		req.DryRun = true
+	}
+
+	bundle, err := config.ParseBundle(req.Bundle)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	resp := ConfigImportResponse{SchemaVersion: bundle.SchemaVersion}
+	var before config.Config
+	preview := func(cfg *config.Config) error {
+		before = *cfg
+		imported, placeholders := bundle.Apply(*cfg, req.Secrets)
+
+		resp.Errors = validateConfigUpdate(imported)
+		for _, p := range placeholders {
+			if p.Status == config.PlaceholderMissing {
+				resp.Errors = append(resp.Errors, config.FieldError{Field: p.Field, Message: "secret placeholder must be filled"})
+			}
+		}
+		resp.Valid = len(resp.Errors) == 0
+		resp.Placeholders = placeholders
+		resp.Changes = diffValues(before, imported)
+		if resp.Changes == nil {
+			resp.Changes = []mongo.FieldChange{}
+		}
+
+		if !resp.Valid {
+			return config.ValidationErrors(resp.Errors)
+		}
+		*cfg = imported
+		return nil
+	}
+
+	if req.DryRun {
+		current := s.configManager.Get()
+		preview(&current)
+		WriteJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	comment := fmt.Sprintf("import of bundle exported %s", bundle.ExportedAt.Format(time.RFC3339))
+	if bundle.ExportedBy != "" {
+		comment += " by " + bundle.ExportedBy
+	}
+	err = s.configManager.Modify(preview, actorName(r), comment)
+	var invalid config.ValidationErrors
+	switch {
+	case err == nil:
+	case errors.As(err, &invalid):
+		WriteJSON(w, http.StatusUnprocessableEntity, resp)
+		return
+	default:
+		log.Printf("[config] Error importing bundle: %v", err)
+		WriteError(w, http.StatusInternalServerError, "Failed to import config: "+err.Error())
+		return
+	}
+
+	resp.Applied = true
+	log.Printf("[config] Imported config bundle (%d changes)", len(resp.Changes))
+	s.audit(r, auditRecord{
+		Action:  "config.import",
+		Target:  "config",
+		Before:  before,
+		After:   s.configManager.Get(),
+		Details: map[string]string{"comment": comment},
+	})
+	WriteJSON(w, http.StatusOK, resp)
+}
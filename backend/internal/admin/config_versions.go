@@ -0,0 +1,138 @@
+package admin
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/omnipoll/backend/internal/config"
+	"github.com/omnipoll/backend/internal/mongo"
+)
+
+// ConfigDiffResponse is the field-level difference between two config versions
+type ConfigDiffResponse struct {
+	From    config.Version      `json:"from"`
+	To      config.Version      `json:"to"`
+	Changes []mongo.FieldChange `json:"changes"`
+}
+
+// handleConfigVersions lists the saved config versions, newest first
+func (s *Server) handleConfigVersions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	versions, err := s.configManager.Versions()
+	if err != nil {
+		log.Printf("[config] Error listing versions: %v", err)
+		WriteError(w, http.StatusInternalServerError, "Failed to list config versions: "+err.Error())
+		return
+	}
+	WriteSuccess(w, http.StatusOK, versions)
+}
+
+// handleConfigVersion serves GET /api/config/versions/diff?from=N&to=M and
+// POST /api/config/versions/{n}/rollback
+func (s *Server) handleConfigVersion(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/config/versions/"), "/")
+
+	if path == "diff" {
+		if r.Method != http.MethodGet {
+			WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		s.handleConfigDiff(w, r)
+		return
+	}
+
+	number, action, _ := strings.Cut(path, "/")
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 1 || action != "rollback" {
+		WriteError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	before := s.configManager.Get()
+	if err := s.configManager.Rollback(n, actorName(r)); err != nil {
+		log.Printf("[config] Error rolling back to version %d: %v", n, err)
+		if errors.Is(err, config.ErrVersionNotFound) {
+			WriteError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		var invalid config.ValidationErrors
+		if errors.As(err, &invalid) {
+			WriteJSON(w, http.StatusUnprocessableEntity, ConfigValidationResponse{Valid: false, Errors: invalid})
+			return
+		}
+		WriteError(w, http.StatusInternalServerError, "Failed to roll back config: "+err.Error())
+		return
+	}
+	log.Printf("[config] Rolled back to version %d", n)
+	s.audit(r, auditRecord{
+		Action:  "config.rollback",
+		Target:  "config",
+		Before:  before,
+		After:   s.configManager.Get(),
+		Details: map[string]string{"version": number},
+	})
+
+	WriteSuccess(w, http.StatusOK, map[string]int{"rolledBackTo": n})
+}
+
+// handleConfigDiff compares two versions; "to" defaults to the latest one.
+// Secret values are masked.
+func (s *Server) handleConfigDiff(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, err := strconv.Atoi(query.Get("from"))
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, "from must be a version number")
+		return
+	}
+
+	to := 0
+	if t := query.Get("to"); t != "" {
+		if to, err = strconv.Atoi(t); err != nil {
+			WriteError(w, http.StatusBadRequest, "to must be a version number")
+			return
+		}
+	} else {
+		versions, err := s.configManager.Versions()
+		if err != nil || len(versions) == 0 {
+			WriteError(w, http.StatusNotFound, "No config versions recorded")
+			return
+		}
+		to = versions[0].Number
+	}
+
+	fromCfg, fromVersion, err := s.configManager.VersionConfig(from)
+	if err != nil {
+		writeVersionError(w, err)
+		return
+	}
+	toCfg, toVersion, err := s.configManager.VersionConfig(to)
+	if err != nil {
+		writeVersionError(w, err)
+		return
+	}
+
+	changes := diffValues(fromCfg, toCfg)
+	if changes == nil {
+		changes = []mongo.FieldChange{}
+	}
+	WriteSuccess(w, http.StatusOK, ConfigDiffResponse{From: fromVersion, To: toVersion, Changes: changes})
+}
+
+func writeVersionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, config.ErrVersionNotFound) {
+		WriteError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	WriteError(w, http.StatusInternalServerError, err.Error())
+}
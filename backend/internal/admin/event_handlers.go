@@ -142,6 +142,8 @@ func (s *Server) handleEventUpdate(w http.ResponseWriter, r *http.Request, event
 		return
 	}
 
+	before, _ := s.worker.GetEventByID(r.Context(), eventID)
+
 	if err := s.worker.UpdateEvent(r.Context(), eventID, updateData); err != nil {
 		log.Printf("Error updating event: %v", err)
 		WriteError(w, http.StatusInternalServerError, "Failed to update event: "+err.Error())
@@ -154,17 +156,21 @@ func (s *Server) handleEventUpdate(w http.ResponseWriter, r *http.Request, event
 		WriteError(w, http.StatusInternalServerError, "Event updated but failed to retrieve")
 		return
 	}
+	s.audit(r, auditRecord{Action: "event.update", Target: "event:" + eventID, Before: before, After: event})
 
 	WriteSuccess(w, http.StatusOK, event)
 }
 
 // handleEventDelete deletes an event
 func (s *Server) handleEventDelete(w http.ResponseWriter, r *http.Request, eventID string) {
+	before, _ := s.worker.GetEventByID(r.Context(), eventID)
+
 	if err := s.worker.DeleteEvent(r.Context(), eventID); err != nil {
 		log.Printf("Error deleting event: %v", err)
 		WriteError(w, http.StatusInternalServerError, "Failed to delete event: "+err.Error())
 		return
 	}
+	s.audit(r, auditRecord{Action: "event.delete", Target: "event:" + eventID, Before: before})
 
 	WriteSuccess(w, http.StatusOK, map[string]string{"message": "Event deleted successfully"})
 }
@@ -204,6 +210,15 @@ func (s *Server) handleEventsBatch(w http.ResponseWriter, r *http.Request) {
 		WriteError(w, http.StatusInternalServerError, "Failed to delete events: "+err.Error())
 		return
 	}
+	s.audit(r, auditRecord{
+		Action: "events.batch_delete",
+		Target: "events",
+		Details: map[string]string{
+			"source":     batchOpts.Source,
+			"beforeDate": batchOpts.BeforeDate,
+			"deleted":    strconv.FormatInt(deleted, 10),
+		},
+	})
 
 	WriteSuccess(w, http.StatusOK, map[string]interface{}{
 		"message": "Batch delete completed",
@@ -2,23 +2,28 @@ package admin
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/omnipoll/backend/internal/config"
 	"github.com/omnipoll/backend/internal/events"
+	"github.com/omnipoll/backend/internal/mqtt"
 )
 
 // StatusResponse represents the system status
 type StatusResponse struct {
-	WorkerRunning  bool              `json:"workerRunning"`
-	LastFechaHora  string            `json:"lastFechaHora"`
-	EventsToday    int64             `json:"eventsToday"`
-	IngestionRate  float64           `json:"ingestionRate"`
-	TotalEvents    int64             `json:"totalEvents"`
-	Connections    ConnectionsStatus `json:"connections"`
-	UptimeSeconds  int64             `json:"uptimeSeconds"`
+	WorkerRunning bool                `json:"workerRunning"`
+	LastFechaHora string              `json:"lastFechaHora"`
+	EventsToday   int64               `json:"eventsToday"`
+	IngestionRate float64             `json:"ingestionRate"`
+	TotalEvents   int64               `json:"totalEvents"`
+	Connections   ConnectionsStatus   `json:"connections"` // mqtt is the primary broker
+	MQTTBrokers   []mqtt.BrokerStatus `json:"mqttBrokers"` // Every MQTT output, primary first
+	UptimeSeconds int64               `json:"uptimeSeconds"`
 }
 
 type ConnectionsStatus struct {
@@ -27,6 +32,13 @@ type ConnectionsStatus struct {
 	MongoDB   bool `json:"mongodb"`
 }
 
+// ConfigResponse is the config as returned by GET /api/config, with the
+// source of each "section.field" value (config file or environment)
+type ConfigResponse struct {
+	config.Config
+	Sources map[string]config.ValueSource `json:"sources"`
+}
+
 var startTime = time.Now()
 
 // handleStatus returns system status
@@ -36,14 +48,27 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	resp := s.currentStatus()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding status response: %v", err)
+	}
+}
+
+// currentStatus reports the worker and its connections, for the status
+// API and the MQTT status command
+func (s *Server) currentStatus() StatusResponse {
 	var lastFechaHora string
 	var eventsToday, totalEvents int64
 	var ingestionRate float64
 	var sqlConnected, mqttConnected, mongoConnected bool
 	var workerRunning bool
+	var brokers []mqtt.BrokerStatus
 
 	if s.worker != nil {
 		workerRunning = s.worker.IsRunning()
+		brokers = s.worker.MQTTBrokers()
 		stats := s.worker.GetStats()
 		if !stats.LastFechaHora.IsZero() {
 			lastFechaHora = stats.LastFechaHora.Format(time.RFC3339)
@@ -56,7 +81,7 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 		mongoConnected = stats.MongoConnected
 	}
 
-	resp := StatusResponse{
+	return StatusResponse{
 		WorkerRunning:  workerRunning,
 		LastFechaHora:  lastFechaHora,
 		EventsToday:    eventsToday,
@@ -67,13 +92,9 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 			MQTT:      mqttConnected,
 			MongoDB:   mongoConnected,
 		},
+		MQTTBrokers:   brokers,
 		UptimeSeconds: int64(time.Since(startTime).Seconds()),
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		log.Printf("Error encoding status response: %v", err)
-	}
 }
 
 // handleConfig handles GET and PUT for configuration
@@ -81,14 +102,41 @@ func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		cfg := s.configManager.Get()
-		log.Printf("[config] GET: Returning MQTT config: %+v", cfg.MQTT)
 		// Mask passwords in response
 		cfg.SQLServer.Password = maskPassword(cfg.SQLServer.Password)
 		cfg.MQTT.Password = maskPassword(cfg.MQTT.Password)
+		cfg.MQTT.TLSClientKey = maskPassword(cfg.MQTT.TLSClientKey)
+		// Secret references are not secret themselves; show them so they survive a round trip
+		refs := s.configManager.SecretReferences()
+		if ref, ok := refs["sqlServer.password"]; ok {
+			cfg.SQLServer.Password = ref
+		}
+		if ref, ok := refs["mqtt.password"]; ok {
+			cfg.MQTT.Password = ref
+		}
+		if ref, ok := refs["mqtt.tlsClientKey"]; ok {
+			cfg.MQTT.TLSClientKey = ref
+		}
+		cfg.MQTT.Outputs = append([]config.MQTTOutput(nil), cfg.MQTT.Outputs...)
+		for i := range cfg.MQTT.Outputs {
+			out := &cfg.MQTT.Outputs[i]
+			out.Password = maskPassword(out.Password)
+			out.TLSClientKey = maskPassword(out.TLSClientKey)
+			if ref, ok := refs["mqtt.outputs."+out.Name+".password"]; ok {
+				out.Password = ref
+			}
+			if ref, ok := refs["mqtt.outputs."+out.Name+".tlsClientKey"]; ok {
+				out.TLSClientKey = ref
+			}
+		}
 		cfg.Admin.Password = maskPassword(cfg.Admin.Password)
+		cfg.Admin.Users = append([]config.AdminUser(nil), cfg.Admin.Users...)
+		for i := range cfg.Admin.Users {
+			cfg.Admin.Users[i].Password = maskPassword(cfg.Admin.Users[i].Password)
+		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(cfg)
+		json.NewEncoder(w).Encode(ConfigResponse{Config: cfg, Sources: s.configManager.Sources()})
 
 	case http.MethodPut:
 		var cfg config.Config
@@ -97,109 +145,201 @@ func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
 			return
 		}
-		log.Printf("[config] Received config update: MQTT=%+v, MongoDB=%+v, SQLServer=%+v, Polling=%+v", 
-			cfg.MQTT, cfg.MongoDB, cfg.SQLServer, cfg.Polling)
+		log.Printf("[config] Received config update: MQTT=%s:%d, SQLServer=%s:%d",
+			cfg.MQTT.Broker, cfg.MQTT.Port, cfg.SQLServer.Host, cfg.SQLServer.Port)
 
-		// Get current config to preserve unmodified fields
+		// Masked secrets keep their current value; everything else is
+		// taken as sent, so emptied required fields fail validation
 		currentCfg := s.configManager.Get()
+		keepMaskedSecrets(&cfg, currentCfg)
+		if errs := validateConfigUpdate(cfg); len(errs) > 0 {
+			log.Printf("[config] Rejected invalid config: %v", errs)
+			WriteJSON(w, http.StatusUnprocessableEntity, ConfigValidationResponse{Valid: false, Errors: errs})
+			return
+		}
 
-		// If Admin section is empty, keep the current one (don't let frontend override it)
-		if cfg.Admin.Host == "" && cfg.Admin.Username == "" && cfg.Admin.Port == 0 {
-			cfg.Admin = currentCfg.Admin
-		} else {
-			// Preserve admin password if masked or empty
-			if cfg.Admin.Password == "********" || cfg.Admin.Password == "" {
-				cfg.Admin.Password = currentCfg.Admin.Password
-			}
-			if cfg.Admin.Host == "" {
-				cfg.Admin.Host = currentCfg.Admin.Host
-			}
-			if cfg.Admin.Port == 0 {
-				cfg.Admin.Port = currentCfg.Admin.Port
-			}
-			if cfg.Admin.Username == "" {
-				cfg.Admin.Username = currentCfg.Admin.Username
+		log.Printf("[config] Saving config...")
+		if err := s.configManager.Update(cfg, actorName(r), ""); err != nil {
+			var invalid config.ValidationErrors
+			if errors.As(err, &invalid) {
+				WriteJSON(w, http.StatusUnprocessableEntity, ConfigValidationResponse{Valid: false, Errors: invalid})
+				return
 			}
+			log.Printf("[config] Error saving config: %v", err)
+			http.Error(w, "Failed to save config: "+err.Error(), http.StatusInternalServerError)
+			return
 		}
+		log.Printf("[config] Config saved successfully")
+		s.audit(r, auditRecord{Action: "config.update", Target: "config", Before: currentCfg, After: cfg})
+		// Note: Worker will reload config on next Initialize() call or manual trigger
 
-		// If password is masked or empty, keep the original
-		if cfg.SQLServer.Password == "********" || cfg.SQLServer.Password == "" {
-			cfg.SQLServer.Password = currentCfg.SQLServer.Password
-		}
-		if cfg.MQTT.Password == "********" || cfg.MQTT.Password == "" {
-			cfg.MQTT.Password = currentCfg.MQTT.Password
-		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 
-		// Validate that required fields are not empty
-		if cfg.MQTT.Broker == "" {
-			cfg.MQTT.Broker = currentCfg.MQTT.Broker
-		}
-		if cfg.MQTT.Port == 0 {
-			cfg.MQTT.Port = currentCfg.MQTT.Port
-		}
-		if cfg.MQTT.Topic == "" {
-			cfg.MQTT.Topic = currentCfg.MQTT.Topic
-		}
-		if cfg.MQTT.ClientID == "" {
-			cfg.MQTT.ClientID = currentCfg.MQTT.ClientID
-		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
 
-		if cfg.SQLServer.Host == "" {
-			cfg.SQLServer.Host = currentCfg.SQLServer.Host
-		}
-		if cfg.SQLServer.Port == 0 {
-			cfg.SQLServer.Port = currentCfg.SQLServer.Port
-		}
-		if cfg.SQLServer.Database == "" {
-			cfg.SQLServer.Database = currentCfg.SQLServer.Database
+// keepMaskedSecrets restores secrets sent back in their masked form
+func keepMaskedSecrets(cfg *config.Config, current config.Config) {
+	if cfg.SQLServer.Password == "********" {
+		cfg.SQLServer.Password = current.SQLServer.Password
+	}
+	if cfg.MQTT.Password == "********" {
+		cfg.MQTT.Password = current.MQTT.Password
+	}
+	if cfg.MQTT.TLSClientKey == "********" {
+		cfg.MQTT.TLSClientKey = current.MQTT.TLSClientKey
+	}
+	keepOutputSecrets(cfg.MQTT.Outputs, current.MQTT.Outputs)
+	if cfg.Admin.Password == "********" {
+		cfg.Admin.Password = current.Admin.Password
+	}
+	for i, u := range cfg.Admin.Users {
+		if u.Password != "********" {
+			continue
 		}
-		if cfg.SQLServer.User == "" {
-			cfg.SQLServer.User = currentCfg.SQLServer.User
+		for _, existing := range current.Admin.Users {
+			if existing.Username == u.Username {
+				cfg.Admin.Users[i].Password = existing.Password
+				break
+			}
 		}
+	}
+}
 
-		if cfg.MongoDB.URI == "" {
-			cfg.MongoDB.URI = currentCfg.MongoDB.URI
-		}
-		if cfg.MongoDB.Database == "" {
-			cfg.MongoDB.Database = currentCfg.MongoDB.Database
-		}
-		if cfg.MongoDB.Collection == "" {
-			cfg.MongoDB.Collection = currentCfg.MongoDB.Collection
+// keepOutputSecrets restores the masked password and client key of each
+// MQTT output from the current output of the same name
+func keepOutputSecrets(outputs, current []config.MQTTOutput) {
+	for i, out := range outputs {
+		for _, existing := range current {
+			if existing.Name != out.Name {
+				continue
+			}
+			if out.Password == "********" {
+				outputs[i].Password = existing.Password
+			}
+			if out.TLSClientKey == "********" {
+				outputs[i].TLSClientKey = existing.TLSClientKey
+			}
+			break
 		}
+	}
+}
 
-		if cfg.Polling.IntervalMS == 0 {
-			cfg.Polling.IntervalMS = currentCfg.Polling.IntervalMS
-		}
-		if cfg.Polling.BatchSize == 0 {
-			cfg.Polling.BatchSize = currentCfg.Polling.BatchSize
-		}
+// ConfigValidationResponse lists the invalid fields of a submitted config
+type ConfigValidationResponse struct {
+	Valid  bool                `json:"valid"`
+	Errors []config.FieldError `json:"errors"`
+}
 
-		if cfg.Admin.Host == "" {
-			cfg.Admin.Host = currentCfg.Admin.Host
-		}
-		if cfg.Admin.Port == 0 {
-			cfg.Admin.Port = currentCfg.Admin.Port
+// validateConfigUpdate returns the field errors of a config update
+func validateConfigUpdate(cfg config.Config) []config.FieldError {
+	errs := []config.FieldError{}
+	var invalid config.ValidationErrors
+	if err := cfg.Validate(); errors.As(err, &invalid) {
+		errs = append(errs, invalid...)
+	}
+	return errs
+}
+
+// handleConfigValidate checks a config like PUT /api/config would, without saving it
+func (s *Server) handleConfigValidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var cfg config.Config
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	keepMaskedSecrets(&cfg, s.configManager.Get())
+
+	errs := validateConfigUpdate(cfg)
+	WriteJSON(w, http.StatusOK, ConfigValidationResponse{Valid: len(errs) == 0, Errors: errs})
+}
+
+// handleConfigSection applies a JSON Merge Patch to a single config
+// section (PATCH /api/config/{section}). Omitted fields are left alone and
+// explicit nulls clear a value.
+func (s *Server) handleConfigSection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	section := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/config/"), "/")
+	patch, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	var before, after config.Config
+	err = s.configManager.Modify(func(cfg *config.Config) error {
+		before = *cfg
+		if err := config.PatchSection(cfg, section, patch); err != nil {
+			return err
 		}
-		if cfg.Admin.Username == "" {
-			cfg.Admin.Username = currentCfg.Admin.Username
+		keepMaskedSecrets(cfg, before)
+		if errs := validateConfigUpdate(*cfg); len(errs) > 0 {
+			return config.ValidationErrors(errs)
 		}
+		after = *cfg
+		return nil
+	}, actorName(r), "patch "+section)
+
+	var invalid config.ValidationErrors
+	switch {
+	case err == nil:
+	case errors.Is(err, config.ErrUnknownSection):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, config.ErrInvalidPatch):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.As(err, &invalid):
+		WriteJSON(w, http.StatusUnprocessableEntity, ConfigValidationResponse{Valid: false, Errors: invalid})
+		return
+	default:
+		log.Printf("[config] Error patching %s: %v", section, err)
+		http.Error(w, "Failed to save config: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		log.Printf("[config] Validated config: MQTT=%+v", cfg.MQTT)
-		log.Printf("[config] Saving config...")
-		if err := s.configManager.Update(cfg); err != nil {
-			log.Printf("[config] Error saving config: %v", err)
-			http.Error(w, "Failed to save config: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		log.Printf("[config] Config saved successfully")
-		// Note: Worker will reload config on next Initialize() call or manual trigger
+	log.Printf("[config] Section %s patched", section)
+	s.audit(r, auditRecord{Action: "config.patch", Target: "config." + section, Before: before, After: after})
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
 
-	default:
+// handleConfigReload re-reads the config file and re-resolves secret references
+func (s *Server) handleConfigReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
+
+	before := s.configManager.Get()
+	if err := s.configManager.Load(); err != nil {
+		var invalid config.ValidationErrors
+		if errors.As(err, &invalid) {
+			// The running config is kept
+			WriteJSON(w, http.StatusUnprocessableEntity, ConfigValidationResponse{Valid: false, Errors: invalid})
+			return
+		}
+		log.Printf("[config] Error reloading config: %v", err)
+		http.Error(w, "Failed to reload config: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.audit(r, auditRecord{Action: "config.reload", Target: "config", Before: before, After: s.configManager.Get()})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "reloaded"})
 }
 
 // handleWorkerStart starts the polling worker
@@ -224,6 +364,7 @@ func (s *Server) handleWorkerStart(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to start worker: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	s.audit(r, auditRecord{Action: "worker.start", Target: "worker"})
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "started"})
@@ -248,6 +389,7 @@ func (s *Server) handleWorkerStop(w http.ResponseWriter, r *http.Request) {
 	}
 
 	s.worker.Stop()
+	s.audit(r, auditRecord{Action: "worker.stop", Target: "worker"})
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "stopped"})
@@ -270,10 +412,12 @@ func (s *Server) handleWatermarkReset(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	before := s.worker.GetWatermark()
 	if err := s.worker.ResetWatermark(); err != nil {
 		http.Error(w, "Failed to reset watermark: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	s.audit(r, auditRecord{Action: "watermark.reset", Target: "watermark", Before: before, After: s.worker.GetWatermark()})
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "reset"})
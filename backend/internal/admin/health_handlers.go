@@ -0,0 +1,98 @@
+package admin
+
+import (
+	"net/http"
+	"time"
+)
+
+// HealthCheck is the result of a single readiness check
+type HealthCheck struct {
+	OK       bool   `json:"ok"`
+	Required bool   `json:"required"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// ReadinessResponse is the body returned by /readyz
+type ReadinessResponse struct {
+	Status string                 `json:"status"` // "ready" or "not_ready"
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+// handleHealthz reports that the process is alive. It never touches the
+// backends so a slow database cannot get the container restarted.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"status":        "ok",
+		"uptimeSeconds": int64(time.Since(startTime).Seconds()),
+	})
+}
+
+// handleReadyz checks dependencies, worker state and watermark lag.
+// Returns 503 when any required check fails.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	cfg := s.configManager.Get().Health
+	required := make(map[string]bool)
+	for _, dep := range cfg.RequiredDependencies {
+		required[dep] = true
+	}
+
+	checks := make(map[string]HealthCheck)
+
+	if s.worker == nil {
+		checks["worker"] = HealthCheck{OK: false, Required: true, Detail: "worker not initialized"}
+	} else {
+		for name, ok := range s.worker.DependencyHealth() {
+			check := HealthCheck{OK: ok, Required: required[name]}
+			if !ok {
+				check.Detail = "not connected"
+			}
+			checks[name] = check
+		}
+
+		running := s.worker.IsRunning()
+		workerCheck := HealthCheck{OK: running, Required: cfg.RequireWorker}
+		if !running {
+			workerCheck.Detail = "worker stopped"
+		}
+		checks["worker"] = workerCheck
+
+		if cfg.MaxWatermarkLagSec > 0 {
+			checks["watermark"] = watermarkCheck(s.worker.GetWatermark().LastFechaHora, cfg.MaxWatermarkLagSec)
+		}
+	}
+
+	resp := ReadinessResponse{Status: "ready", Checks: checks}
+	statusCode := http.StatusOK
+	for _, check := range checks {
+		if check.Required && !check.OK {
+			resp.Status = "not_ready"
+			statusCode = http.StatusServiceUnavailable
+			break
+		}
+	}
+
+	WriteJSON(w, statusCode, resp)
+}
+
+// watermarkCheck compares the age of the last processed record with the
+// threshold. A fresh install has no watermark yet, which is not a failure.
+func watermarkCheck(lastFechaHora time.Time, maxLagSec int) HealthCheck {
+	if lastFechaHora.IsZero() {
+		return HealthCheck{OK: false, Required: false, Detail: "no records processed yet"}
+	}
+
+	lag := time.Since(lastFechaHora)
+	check := HealthCheck{OK: lag <= time.Duration(maxLagSec)*time.Second, Required: true}
+	check.Detail = "lag " + lag.Truncate(time.Second).String()
+	return check
+}
@@ -1,31 +1,83 @@
 package admin
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
+
+	"github.com/omnipoll/backend/internal/telemetry"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// withAuth wraps a handler with basic authentication
-func (s *Server) withAuth(next http.HandlerFunc) http.HandlerFunc {
+// withAuth authenticates the caller and
+// checks that they hold the permission required for the request method
+func (s *Server) withAuth(acc access, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cfg := s.configManager.Get()
-
-		// Skip auth if no credentials configured
-		if cfg.Admin.Username == "" && cfg.Admin.Password == "" {
-			next(w, r)
+		principal, err := s.authenticate(r)
+		if err != nil {
+			var locked *lockedError
+			if errors.As(err, &locked) {
+				w.Header().Set("Retry-After", strconv.Itoa(int(locked.retryAfter.Seconds())+1))
+				http.Error(w, locked.Error(), http.StatusTooManyRequests)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="Omnipoll Admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		user, pass, ok := r.BasicAuth()
-		if !ok || user != cfg.Admin.Username || pass != cfg.Admin.Password {
-			w.Header().Set("WWW-Authenticate", `Basic realm="Omnipoll Admin"`)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		if perm := acc.required(r.Method); perm != "" && !principal.Can(perm) {
+			WriteError(w, http.StatusForbidden, "Forbidden: requires "+string(perm))
 			return
 		}
 
-		next(w, r)
+		next(w, r.WithContext(withPrincipal(r.Context(), principal)))
+	}
+}
+
+// authenticate resolves the request credentials (API key, session token
+// or basic auth, in that order) to a principal
+func (s *Server) authenticate(r *http.Request) (*Principal, error) {
+	if key := apiKeyFromRequest(r); key != "" {
+		k, ok := s.apiKeys.Authenticate(key)
+		if !ok {
+			return nil, errUnauthorized
+		}
+		return NewAPIKeyPrincipal(k), nil
+	}
+
+	if token := sessionToken(r); token != "" {
+		if sess, ok := s.sessions.lookup(token); ok {
+			if principal, ok := s.principalForUser(sess.username); ok {
+				return principal, nil
+			}
+		}
+		// Fall through: a stale cookie must not block basic auth
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return nil, errUnauthorized
+	}
+	admin := s.configManager.Get().Admin
+	if s.sessions.recallBasic(admin, user, pass) {
+		if principal, ok := s.principalForUser(user); ok {
+			return principal, nil
+		}
+	}
+	principal, err := s.login(r, user, pass)
+	if err != nil {
+		return nil, err
 	}
+	s.sessions.rememberBasic(admin, user, pass)
+	return principal, nil
 }
 
 // withCORS adds CORS headers for development
@@ -36,8 +88,8 @@ func (s *Server) withCORS(next http.Handler) http.Handler {
 		if origin != "" {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 			w.Header().Set("Access-Control-Allow-Credentials", "true")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
 		}
 
 		// Handle preflight
@@ -50,6 +102,14 @@ func (s *Server) withCORS(next http.Handler) http.Handler {
 	})
 }
 
+// quietPaths are polled frequently by the frontend or probes and not logged
+var quietPaths = map[string]bool{
+	"/api/status": true,
+	"/api/events": true,
+	"/healthz":    true,
+	"/readyz":     true,
+}
+
 // withLogging logs each request (excluding frequent API calls)
 func (s *Server) withLogging(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -61,12 +121,40 @@ func (s *Server) withLogging(next http.Handler) http.Handler {
 		next.ServeHTTP(wrapped, r)
 
 		// Only log non-polling API requests to reduce noise
-		if r.URL.Path != "/api/status" && r.URL.Path != "/api/events" {
+		if !quietPaths[r.URL.Path] {
 			log.Printf("%s %s %d %v", r.Method, r.URL.Path, wrapped.statusCode, time.Since(start))
 		}
 	})
 }
 
+// withTracing starts a server span for each request, continuing any
+// trace propagated by the caller. Spans are named after the route, so
+// IDs in the path only appear in http.target.
+func (s *Server) withTracing(route func(r *http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		pattern := route(r)
+		ctx, span := telemetry.Tracer().Start(ctx, fmt.Sprintf("%s %s", r.Method, pattern),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.route", pattern),
+				attribute.String("http.target", r.URL.Path),
+				attribute.String("http.client_ip", r.RemoteAddr),
+			),
+		)
+		defer span.End()
+
+		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(wrapped, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.status_code", wrapped.statusCode))
+		if wrapped.statusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(wrapped.statusCode))
+		}
+	})
+}
+
 // responseWriter wraps http.ResponseWriter to capture status code
 type responseWriter struct {
 	http.ResponseWriter
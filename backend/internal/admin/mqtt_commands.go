@@ -0,0 +1,149 @@
+package admin
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/omnipoll/backend/internal/mqtt"
+)
+
+// commandPermissions is what the API key of each MQTT command must hold
+var commandPermissions = map[string]Permission{
+	mqtt.CommandStart:   PermWorkerManage,
+	mqtt.CommandStop:    PermWorkerManage,
+	mqtt.CommandPollNow: PermWorkerManage,
+	mqtt.CommandReplay:  PermWorkerManage,
+	mqtt.CommandStatus:  PermStatusRead,
+}
+
+// rejectionAuditInterval is how often a command without a valid API key
+// is audited; the ones in between are only counted
+const rejectionAuditInterval = time.Minute
+
+// rejectionThrottle limits the audit records of unauthenticated MQTT
+// commands, which anyone allowed to publish on the command topic can send
+type rejectionThrottle struct {
+	mu         sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+// allow reports whether a rejection may be audited now, and how many were
+// suppressed since the last audited one
+func (t *rejectionThrottle) allow() (bool, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Since(t.last) < rejectionAuditInterval {
+		t.suppressed++
+		return false, 0
+	}
+	suppressed := t.suppressed
+	t.last, t.suppressed = time.Now(), 0
+	return true, suppressed
+}
+
+// handleMQTTCommand authenticates and runs a command received on
+// {topicPrefix}/cmd/{command}. Every authenticated command is audited,
+// including rejected ones; unauthenticated ones at most once per
+// rejectionAuditInterval.
+func (s *Server) handleMQTTCommand(cmd mqtt.Command) mqtt.CommandReply {
+	actor := "unknown"
+	authenticated := false
+	details := map[string]string{"command": cmd.Name, "id": cmd.ID, "outcome": "ok"}
+	if cmd.Name == mqtt.CommandReplay {
+		details["from"], details["to"] = cmd.From, cmd.To
+	}
+
+	result, err := func() (interface{}, error) {
+		key, ok := s.apiKeys.Authenticate(cmd.APIKey)
+		if !ok {
+			return nil, errUnauthorized
+		}
+		principal := NewAPIKeyPrincipal(key)
+		actor, authenticated = principal.Name, true
+		perm, ok := commandPermissions[cmd.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown command %q", cmd.Name)
+		}
+		if !principal.Can(perm) {
+			return nil, fmt.Errorf("forbidden: requires %s", perm)
+		}
+		return s.runMQTTCommand(cmd)
+	}()
+
+	reply := mqtt.CommandReply{OK: err == nil, Result: result, Authenticated: authenticated}
+	if err != nil {
+		reply.Error = err.Error()
+		details["outcome"] = "failed"
+		details["error"] = err.Error()
+	}
+	if !authenticated {
+		ok, suppressed := s.rejectedCommands.allow()
+		if !ok {
+			return reply
+		}
+		if suppressed > 0 {
+			details["suppressed"] = strconv.Itoa(suppressed)
+		}
+	}
+	s.auditAs(actor, "mqtt", auditRecord{Action: "mqtt.command", Target: "command:" + cmd.Name, Details: details})
+	return reply
+}
+
+// runMQTTCommand runs an authorized command and returns its result
+func (s *Server) runMQTTCommand(cmd mqtt.Command) (interface{}, error) {
+	switch cmd.Name {
+	case mqtt.CommandStart:
+		if s.worker.IsRunning() {
+			return map[string]string{"status": "already_running"}, nil
+		}
+		if err := s.worker.Start(); err != nil {
+			return nil, fmt.Errorf("failed to start worker: %w", err)
+		}
+		return map[string]string{"status": "started"}, nil
+
+	case mqtt.CommandStop:
+		if !s.worker.IsRunning() {
+			return map[string]string{"status": "already_stopped"}, nil
+		}
+		s.worker.Stop()
+		return map[string]string{"status": "stopped"}, nil
+
+	case mqtt.CommandPollNow:
+		cycle, err := s.worker.PollNow()
+		if err != nil {
+			return nil, err
+		}
+		if cycle.Error != "" {
+			return cycle, fmt.Errorf("poll failed: %s", cycle.Error)
+		}
+		return cycle, nil
+
+	case mqtt.CommandReplay:
+		from, err := time.Parse(time.RFC3339, cmd.From)
+		if err != nil {
+			return nil, fmt.Errorf("from: expected an RFC3339 time, got %q", cmd.From)
+		}
+		to, err := time.Parse(time.RFC3339, cmd.To)
+		if err != nil {
+			return nil, fmt.Errorf("to: expected an RFC3339 time, got %q", cmd.To)
+		}
+		if to.Before(from) {
+			return nil, fmt.Errorf("to is before from")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		n, err := s.worker.Replay(ctx, from, to)
+		if err != nil {
+			return nil, fmt.Errorf("replay failed: %w", err)
+		}
+		return map[string]int{"events": n}, nil
+
+	case mqtt.CommandStatus:
+		return s.currentStatus(), nil
+	}
+	return nil, fmt.Errorf("unknown command %q", cmd.Name)
+}
@@ -0,0 +1,35 @@
+package admin
+
+import (
+	"net/http"
+)
+
+// handleMQTTState clears the retained latest-state message of a
+// decommissioned jaula: DELETE /api/mqtt/state?centro=...&jaula=...
+func (s *Server) handleMQTTState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if s.worker == nil {
+		WriteError(w, http.StatusInternalServerError, "Worker not initialized")
+		return
+	}
+
+	centro, jaula := r.URL.Query().Get("centro"), r.URL.Query().Get("jaula")
+	if centro == "" || jaula == "" {
+		WriteError(w, http.StatusBadRequest, "centro and jaula are required")
+		return
+	}
+	if err := s.worker.ClearJaulaState(centro, jaula); err != nil {
+		WriteError(w, http.StatusBadRequest, "Failed to clear state: "+err.Error())
+		return
+	}
+	s.audit(r, auditRecord{
+		Action:  "mqtt.state.clear",
+		Target:  "jaula:" + centro + "/" + jaula,
+		Details: map[string]string{"centro": centro, "jaula": jaula},
+	})
+
+	WriteSuccess(w, http.StatusOK, map[string]string{"message": "State cleared"})
+}
@@ -0,0 +1,152 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/omnipoll/backend/internal/apikeys"
+)
+
+// Role is an admin user's role. Roles are cumulative: an operator can do
+// everything a viewer can, an admin everything an operator can.
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"
+	RoleOperator Role = "operator"
+	RoleAdmin    Role = "admin"
+)
+
+// Permission names a single action on the admin API
+type Permission string
+
+const (
+	PermStatusRead      Permission = "status:read"
+	PermLogsRead        Permission = "logs:read"
+	PermEventsRead      Permission = "events:read"
+	PermEventsWrite     Permission = "events:write"
+	PermWorkerManage    Permission = "worker:manage"
+	PermConnectionsTest Permission = "connections:test"
+	PermConfigRead      Permission = "config:read"
+	PermConfigWrite     Permission = "config:write"
+	PermWatermarkReset  Permission = "watermark:reset"
+	PermAPIKeysManage   Permission = "apikeys:manage"
+	PermAuditRead       Permission = "audit:read"
+)
+
+var viewerPermissions = []Permission{
+	PermStatusRead,
+	PermLogsRead,
+	PermEventsRead,
+}
+
+var operatorPermissions = append([]Permission{
+	PermWorkerManage,
+	PermConnectionsTest,
+}, viewerPermissions...)
+
+var adminPermissions = append([]Permission{
+	PermEventsWrite,
+	PermConfigRead,
+	PermConfigWrite,
+	PermWatermarkReset,
+	PermAPIKeysManage,
+	PermAuditRead,
+}, operatorPermissions...)
+
+// rolePermissions lists what each role is allowed to do
+var rolePermissions = map[Role][]Permission{
+	RoleViewer:   viewerPermissions,
+	RoleOperator: operatorPermissions,
+	RoleAdmin:    adminPermissions,
+}
+
+// ValidPermission reports whether name is a known permission
+func ValidPermission(name string) bool {
+	for _, perm := range adminPermissions {
+		if string(perm) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	Name        string       `json:"name"`
+	Role        Role         `json:"role,omitempty"` // Empty for API keys
+	APIKeyID    string       `json:"apiKeyId,omitempty"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// NewPrincipal builds a principal carrying the permissions of role
+func NewPrincipal(name string, role Role) *Principal {
+	return &Principal{
+		Name:        name,
+		Role:        role,
+		Permissions: rolePermissions[role],
+	}
+}
+
+// NewAPIKeyPrincipal builds a principal limited to the key's scopes
+func NewAPIKeyPrincipal(key apikeys.Key) *Principal {
+	perms := make([]Permission, 0, len(key.Scopes))
+	for _, scope := range key.Scopes {
+		perms = append(perms, Permission(scope))
+	}
+	return &Principal{
+		Name:        "apikey:" + key.Name,
+		APIKeyID:    key.ID,
+		Permissions: perms,
+	}
+}
+
+// Can reports whether the principal holds perm
+func (p *Principal) Can(perm Permission) bool {
+	for _, granted := range p.Permissions {
+		if granted == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// access maps HTTP methods to the permission they require.
+// The empty key applies to any method not listed explicitly.
+type access map[string]Permission
+
+// allMethods requires perm regardless of the HTTP method
+func allMethods(perm Permission) access {
+	return access{"": perm}
+}
+
+// required returns the permission needed for method
+func (a access) required(method string) Permission {
+	if perm, ok := a[method]; ok {
+		return perm
+	}
+	return a[""]
+}
+
+type principalKey struct{}
+
+// withPrincipal stores the authenticated caller in the request context
+func withPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns the authenticated caller, or nil
+func PrincipalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// handleAuthMe returns the authenticated caller and their permissions
+func (s *Server) handleAuthMe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	WriteSuccess(w, http.StatusOK, PrincipalFrom(r.Context()))
+}
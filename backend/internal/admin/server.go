@@ -8,8 +8,10 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/omnipoll/backend/internal/apikeys"
 	"github.com/omnipoll/backend/internal/config"
 	"github.com/omnipoll/backend/internal/poller"
 )
@@ -20,6 +22,12 @@ type Server struct {
 	configManager *config.Manager
 	worker        *poller.Worker
 	staticFS      fs.FS
+	sessions      *sessionStore
+	logins        *loginLimiter
+	apiKeys       *apikeys.Store
+	audits        *auditWriter
+
+	rejectedCommands rejectionThrottle // Audit throttle of unauthenticated MQTT commands
 }
 
 // NewServer creates a new admin server
@@ -38,6 +46,10 @@ func NewServer(cfg *config.Manager, worker *poller.Worker, staticFiles embed.FS)
 		configManager: cfg,
 		worker:        worker,
 		staticFS:      staticFS,
+		sessions:      newSessionStore(),
+		logins:        newLoginLimiter(),
+		apiKeys:       apikeys.NewStore(),
+		audits:        newAuditWriter(worker),
 	}
 
 	return s, nil
@@ -49,6 +61,10 @@ func NewServerWithoutStatic(cfg *config.Manager, worker *poller.Worker) *Server
 		configManager: cfg,
 		worker:        worker,
 		staticFS:      nil,
+		sessions:      newSessionStore(),
+		logins:        newLoginLimiter(),
+		apiKeys:       apikeys.NewStore(),
+		audits:        newAuditWriter(worker),
 	}
 }
 
@@ -62,6 +78,10 @@ func NewServerWithFilesystem(cfg *config.Manager, worker *poller.Worker, staticD
 		configManager: cfg,
 		worker:        worker,
 		staticFS:      staticFS,
+		sessions:      newSessionStore(),
+		logins:        newLoginLimiter(),
+		apiKeys:       apikeys.NewStore(),
+		audits:        newAuditWriter(worker),
 	}
 }
 
@@ -70,24 +90,53 @@ func (s *Server) Start() error {
 	cfg := s.configManager.Get()
 	addr := fmt.Sprintf("%s:%d", cfg.Admin.Host, cfg.Admin.Port)
 
+	if err := s.apiKeys.Load(); err != nil {
+		log.Printf("Warning: Could not load API keys from %s: %v (the file is left untouched; new keys cannot be created)", s.apiKeys.GetPath(), err)
+	}
+
+	// MQTT commands authenticate with the same API keys
+	if s.worker != nil {
+		s.worker.SetCommandHandler(s.handleMQTTCommand)
+	}
+
 	mux := http.NewServeMux()
 	router := NewRouter()
 
+	// Probe routes (unauthenticated, for Docker/Kubernetes)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+
 	// API routes
-	mux.HandleFunc("/api/status", s.withAuth(s.handleStatus))
-	mux.HandleFunc("/api/config", s.withAuth(s.handleConfig))
-	mux.HandleFunc("/api/worker/start", s.withAuth(s.handleWorkerStart))
-	mux.HandleFunc("/api/worker/stop", s.withAuth(s.handleWorkerStop))
-	mux.HandleFunc("/api/watermark/reset", s.withAuth(s.handleWatermarkReset))
-	mux.HandleFunc("/api/test/sqlserver", s.withAuth(s.handleTestSQLServer))
-	mux.HandleFunc("/api/test/mqtt", s.withAuth(s.handleTestMQTT))
-	mux.HandleFunc("/api/test/mongodb", s.withAuth(s.handleTestMongoDB))
-	mux.HandleFunc("/api/logs", s.withAuth(s.handleLogsImproved))
-	
+	mux.HandleFunc("/api/auth/login", s.handleLogin)
+	mux.HandleFunc("/api/auth/logout", s.withAuth(access{}, s.handleLogout))
+	mux.HandleFunc("/api/auth/me", s.withAuth(access{}, s.handleAuthMe))
+	mux.HandleFunc("/api/apikeys", s.withAuth(allMethods(PermAPIKeysManage), s.handleAPIKeys))
+	mux.HandleFunc("/api/apikeys/", s.withAuth(allMethods(PermAPIKeysManage), s.handleAPIKeyByID))
+	mux.HandleFunc("/api/audit", s.withAuth(allMethods(PermAuditRead), s.handleAudit))
+	mux.HandleFunc("/api/status", s.withAuth(allMethods(PermStatusRead), s.handleStatus))
+	mux.HandleFunc("/api/config", s.withAuth(access{http.MethodGet: PermConfigRead, "": PermConfigWrite}, s.handleConfig))
+	mux.HandleFunc("/api/config/", s.withAuth(access{http.MethodGet: PermConfigRead, "": PermConfigWrite}, s.handleConfigSection))
+	mux.HandleFunc("/api/config/export", s.withAuth(allMethods(PermConfigRead), s.handleConfigExport))
+	mux.HandleFunc("/api/config/import", s.withAuth(allMethods(PermConfigWrite), s.handleConfigImport))
+	mux.HandleFunc("/api/config/versions", s.withAuth(allMethods(PermConfigRead), s.handleConfigVersions))
+	mux.HandleFunc("/api/config/versions/", s.withAuth(access{http.MethodGet: PermConfigRead, "": PermConfigWrite}, s.handleConfigVersion))
+	mux.HandleFunc("/api/config/validate", s.withAuth(allMethods(PermConfigWrite), s.handleConfigValidate))
+	mux.HandleFunc("/api/config/topic-preview", s.withAuth(allMethods(PermConfigRead), s.handleTopicPreview))
+	mux.HandleFunc("/api/config/reload", s.withAuth(allMethods(PermConfigWrite), s.handleConfigReload))
+	mux.HandleFunc("/api/worker/start", s.withAuth(allMethods(PermWorkerManage), s.handleWorkerStart))
+	mux.HandleFunc("/api/worker/stop", s.withAuth(allMethods(PermWorkerManage), s.handleWorkerStop))
+	mux.HandleFunc("/api/watermark/reset", s.withAuth(allMethods(PermWatermarkReset), s.handleWatermarkReset))
+	mux.HandleFunc("/api/test/sqlserver", s.withAuth(allMethods(PermConnectionsTest), s.handleTestSQLServer))
+	mux.HandleFunc("/api/test/mqtt", s.withAuth(allMethods(PermConnectionsTest), s.handleTestMQTT))
+	mux.HandleFunc("/api/test/mongodb", s.withAuth(allMethods(PermConnectionsTest), s.handleTestMongoDB))
+	mux.HandleFunc("/api/logs", s.withAuth(allMethods(PermLogsRead), s.handleLogsImproved))
+	mux.HandleFunc("/api/mqtt/state", s.withAuth(allMethods(PermEventsWrite), s.handleMQTTState))
+
 	// Events routes (using custom router for ID support)
-	router.HandleFunc("/api/events", s.withAuth(s.handleEventsRoute))
-	router.HandleFunc("/api/events/", s.withAuth(s.handleEventByID))
-	router.HandleFunc("/api/events/batch", s.withAuth(s.handleEventsBatch))
+	eventsAccess := access{http.MethodGet: PermEventsRead, "": PermEventsWrite}
+	router.HandleFunc("/api/events", s.withAuth(eventsAccess, s.handleEventsRoute))
+	router.HandleFunc("/api/events/", s.withAuth(eventsAccess, s.handleEventByID))
+	router.HandleFunc("/api/events/batch", s.withAuth(eventsAccess, s.handleEventsBatch))
 
 	// Static files (frontend)
 	if s.staticFS != nil {
@@ -104,8 +153,25 @@ func (s *Server) Start() error {
 <p>Frontend not embedded. Run frontend dev server at port 3000.</p>
 <h2>API Endpoints:</h2>
 <ul>
+<li>GET /healthz - Liveness probe (no auth)</li>
+<li>GET /readyz - Readiness probe (no auth)</li>
+<li>POST /api/auth/login - Start a session</li>
+<li>POST /api/auth/logout - End the session</li>
+<li>GET /api/auth/me - Current user and permissions</li>
+<li>GET/POST /api/apikeys - List or create API keys</li>
+<li>DELETE /api/apikeys/:id - Revoke an API key</li>
+<li>GET /api/audit - Audit trail of administrative actions</li>
 <li>GET /api/status</li>
 <li>GET/PUT /api/config</li>
+<li>PATCH /api/config/:section - JSON Merge Patch of one section</li>
+<li>GET /api/config/export - Download a config bundle (no secrets)</li>
+<li>POST /api/config/import - Preview (dryRun) or apply a config bundle</li>
+<li>GET /api/config/versions - Saved config versions</li>
+<li>GET /api/config/versions/diff?from=N&amp;to=M - Compare two versions</li>
+<li>POST /api/config/versions/:n/rollback - Restore a version</li>
+<li>POST /api/config/validate - Check a config without saving it</li>
+<li>POST /api/config/topic-preview - Render MQTT topics for sample events</li>
+<li>POST /api/config/reload - Re-read config and secret references</li>
 <li>POST /api/worker/start</li>
 <li>POST /api/worker/stop</li>
 <li>POST /api/watermark/reset</li>
@@ -113,6 +179,7 @@ func (s *Server) Start() error {
 <li>POST /api/test/mqtt</li>
 <li>POST /api/test/mongodb</li>
 <li>GET /api/logs</li>
+<li>DELETE /api/mqtt/state?centro=&amp;jaula= - Clear the retained state of a jaula</li>
 <li>GET /api/events - List events with pagination</li>
 <li>GET /api/events/:id - Get event by ID</li>
 <li>PUT /api/events/:id - Update event</li>
@@ -128,7 +195,7 @@ func (s *Server) Start() error {
 	}
 
 	// Combine mux and router
-	handler := s.withCORS(s.withLogging(combineHandlers(mux, router)))
+	handler := s.withCORS(s.withTracing(routePattern(mux), s.withLogging(combineHandlers(mux, router))))
 
 	s.server = &http.Server{
 		Addr:         addr,
@@ -155,12 +222,34 @@ func combineHandlers(mux *http.ServeMux, router *Router) http.Handler {
 	})
 }
 
+// routePattern returns the function naming the route of a request, for
+// span names: the mux pattern, or /api/events/{id} for the events router
+func routePattern(mux *http.ServeMux) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		switch path := r.URL.Path; {
+		case path == "/api/events" || path == "/api/events/batch":
+			return path
+		case strings.HasPrefix(path, "/api/events/"):
+			return "/api/events/{id}"
+		}
+		if _, pattern := mux.Handler(r); pattern != "" {
+			return pattern
+		}
+		return "unmatched"
+	}
+}
+
 // Stop gracefully stops the server
 func (s *Server) Stop(ctx context.Context) error {
 	if s.server == nil {
 		return nil
 	}
-	return s.server.Shutdown(ctx)
+	if err := s.apiKeys.Flush(); err != nil {
+		log.Printf("Error saving API key usage: %v", err)
+	}
+	err := s.server.Shutdown(ctx)
+	s.audits.close(ctx)
+	return err
 }
 
 // GetAddr returns the server address
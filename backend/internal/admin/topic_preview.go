@@ -0,0 +1,134 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/omnipoll/backend/internal/events"
+	"github.com/omnipoll/backend/internal/mongo"
+	"github.com/omnipoll/backend/internal/mqtt"
+	"github.com/omnipoll/backend/internal/topic"
+)
+
+// topicPreviewSamples is how many recent events are rendered when the
+// request has none
+const topicPreviewSamples = 5
+
+// TopicPreviewRequest is the body of POST /api/config/topic-preview
+type TopicPreviewRequest struct {
+	Template *string                  `json:"template"` // Defaults to the configured mqtt.topicTemplate
+	Events   []events.NormalizedEvent `json:"events"`   // Defaults to recent events
+}
+
+// TopicPreviewResponse lists the topics a template renders
+type TopicPreviewResponse struct {
+	Template  string         `json:"template"` // Empty for the default layout
+	Valid     bool           `json:"valid"`
+	Error     string         `json:"error,omitempty"`
+	Fields    []string       `json:"fields"`
+	Functions []string       `json:"functions"`
+	Topics    []TopicPreview `json:"topics"`
+}
+
+// TopicPreview is the topic of one sample event
+type TopicPreview struct {
+	EventID string `json:"eventId"`
+	Centro  string `json:"centro"`
+	Jaula   string `json:"jaula"`
+	Topic   string `json:"topic,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// handleTopicPreview renders topics for sample events without saving
+// the template
+func (s *Server) handleTopicPreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var req TopicPreviewRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			WriteError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+			return
+		}
+	}
+
+	cfg := s.configManager.Get().MQTT
+	if req.Template != nil {
+		cfg.TopicTemplate = *req.Template
+	}
+	resp := TopicPreviewResponse{
+		Template:  cfg.TopicTemplate,
+		Fields:    topic.FieldNames(),
+		Functions: topic.FuncNames(),
+		Topics:    []TopicPreview{},
+	}
+
+	builder, err := mqtt.NewTopicBuilder(cfg)
+	if err != nil {
+		resp.Error = err.Error()
+		WriteJSON(w, http.StatusOK, resp)
+		return
+	}
+	resp.Valid = true
+
+	samples := req.Events
+	if len(samples) == 0 {
+		samples = s.sampleEvents(r)
+	}
+	for _, event := range samples {
+		preview := TopicPreview{EventID: event.ID, Centro: event.Name, Jaula: event.UnitName}
+		if t, err := builder.Topic(event); err != nil {
+			preview.Error = err.Error()
+		} else {
+			preview.Topic = t
+		}
+		resp.Topics = append(resp.Topics, preview)
+	}
+	WriteJSON(w, http.StatusOK, resp)
+}
+
+// sampleEvents returns recent events from MongoDB, or a made-up event
+// when there are none
+func (s *Server) sampleEvents(r *http.Request) []events.NormalizedEvent {
+	recent, err := s.worker.GetRecentEvents(r.Context(), topicPreviewSamples)
+	if err != nil || len(recent) == 0 {
+		return []events.NormalizedEvent{{
+			ID:        "sample",
+			Source:    "akva",
+			Name:      "Centro Ejemplo",
+			UnitName:  "Jaula 101",
+			Dia:       "2025-01-12",
+			FeedName:  "Alimento 9mm",
+			SiloName:  "Silo 1",
+			DoserName: "Dosificador A",
+		}}
+	}
+
+	samples := make([]events.NormalizedEvent, len(recent))
+	for i, h := range recent {
+		samples[i] = topicFields(h)
+	}
+	return samples
+}
+
+// topicFields rebuilds the text fields topics use from a stored event
+func topicFields(h mongo.HistoricalEvent) events.NormalizedEvent {
+	text := func(key string) string {
+		v, _ := h.Payload[key].(string)
+		return v
+	}
+	return events.NormalizedEvent{
+		ID:        strings.TrimPrefix(h.ID, h.Source+":"),
+		Source:    h.Source,
+		Name:      text("name"),
+		UnitName:  h.UnitName,
+		Dia:       text("dia"),
+		FeedName:  text("feedName"),
+		SiloName:  text("siloName"),
+		DoserName: text("doserName"),
+	}
+}
@@ -0,0 +1,291 @@
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	APIKeysPathEnv     = "OMNIPOLL_APIKEYS_PATH"
+	DefaultAPIKeysPath = "./data/apikeys.json"
+
+	// KeyPrefix marks Omnipoll API keys so they can be told apart from session tokens
+	KeyPrefix = "opk_"
+
+	// lastUsedFlushInterval limits how often last-used timestamps hit the disk
+	lastUsedFlushInterval = time.Minute
+)
+
+// ErrNotFound is returned for an API key ID that does not exist
+var ErrNotFound = errors.New("api key not found")
+
+// Key is a named API key. Only the SHA-256 hash of the secret is stored.
+type Key struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Hash       string     `json:"hash"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	CreatedBy  string     `json:"createdBy"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+}
+
+// Active reports whether the key has not been revoked
+func (k Key) Active() bool {
+	return k.RevokedAt == nil
+}
+
+// Store handles API key persistence
+type Store struct {
+	mu        sync.RWMutex
+	keys      []Key
+	path      string
+	lastFlush time.Time
+	loaded    bool // Load succeeded; until then the file is never written
+	dirty     bool // Last-used timestamps not yet written
+}
+
+// NewStore creates a new API key store
+func NewStore() *Store {
+	path := os.Getenv(APIKeysPathEnv)
+	if path == "" {
+		path = DefaultAPIKeysPath
+	}
+
+	return &Store{
+		path: path,
+		keys: []Key{},
+	}
+}
+
+// Load reads the keys from disk. If it fails, the store refuses to write
+// so that an unreadable file is not replaced by an empty list.
+func (s *Store) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.loaded = true
+			return nil
+		}
+		return err
+	}
+
+	var keys []Key
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+
+	s.keys = keys
+	s.loaded = true
+	return nil
+}
+
+func (s *Store) saveUnlocked() error {
+	if !s.loaded {
+		return fmt.Errorf("api keys were not loaded from %s; not overwriting it", s.path)
+	}
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(s.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(s.path, data, 0600); err != nil {
+		return err
+	}
+	s.lastFlush = time.Now()
+	s.dirty = false
+	return nil
+}
+
+// List returns all keys, including revoked ones
+func (s *Store) List() []Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]Key, len(s.keys))
+	copy(keys, s.keys)
+	return keys
+}
+
+// Create generates a new key and returns it with the plain-text secret.
+// The secret is not stored and cannot be recovered later.
+func (s *Store) Create(name string, scopes []string, createdBy string) (Key, string, error) {
+	idBytes := make([]byte, 6)
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		return Key{}, "", err
+	}
+	if _, err := rand.Read(secretBytes); err != nil {
+		return Key{}, "", err
+	}
+
+	id := hex.EncodeToString(idBytes)
+	plain := KeyPrefix + id + "_" + base64.RawURLEncoding.EncodeToString(secretBytes)
+
+	key := Key{
+		ID:        id,
+		Name:      name,
+		Hash:      hashKey(plain),
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+		CreatedBy: createdBy,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys = append(s.keys, key)
+	if err := s.saveUnlocked(); err != nil {
+		s.keys = s.keys[:len(s.keys)-1]
+		return Key{}, "", err
+	}
+
+	return key, plain, nil
+}
+
+// Revoke disables a key by ID
+func (s *Store) Revoke(id string) (Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.keys {
+		if s.keys[i].ID != id {
+			continue
+		}
+		if s.keys[i].RevokedAt == nil {
+			now := time.Now().UTC()
+			s.keys[i].RevokedAt = &now
+			if err := s.saveUnlocked(); err != nil {
+				s.keys[i].RevokedAt = nil
+				return Key{}, err
+			}
+		}
+		return s.keys[i], nil
+	}
+
+	return Key{}, ErrNotFound
+}
+
+// Authenticate looks up an active key by its plain-text value and
+// records the use
+func (s *Store) Authenticate(plain string) (Key, bool) {
+	id, ok := parseID(plain)
+	if !ok {
+		return Key{}, false
+	}
+	hash := hashKey(plain)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.keys {
+		k := &s.keys[i]
+		if k.ID != id || !k.Active() {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hash)) != 1 {
+			return Key{}, false
+		}
+
+		now := time.Now().UTC()
+		k.LastUsedAt = &now
+		s.dirty = true
+		if time.Since(s.lastFlush) >= lastUsedFlushInterval {
+			// Best effort: a failed write only loses the timestamp
+			_ = s.saveUnlocked()
+		}
+		return *k, true
+	}
+
+	return Key{}, false
+}
+
+// Flush persists pending last-used timestamps, if any
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty || !s.loaded {
+		return nil
+	}
+	return s.saveUnlocked()
+}
+
+// IsAPIKey reports whether a credential looks like an Omnipoll API key
+func IsAPIKey(s string) bool {
+	return strings.HasPrefix(s, KeyPrefix)
+}
+
+// parseID extracts the key ID from "opk_<id>_<secret>"
+func parseID(plain string) (string, bool) {
+	if !IsAPIKey(plain) {
+		return "", false
+	}
+	id, secret, ok := strings.Cut(strings.TrimPrefix(plain, KeyPrefix), "_")
+	if !ok || id == "" || secret == "" {
+		return "", false
+	}
+	return id, true
+}
+
+func hashKey(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetPath returns the API key file path
+func (s *Store) GetPath() string {
+	return s.path
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over
+// path, so a crash never leaves a truncated key file behind
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		// A file bind-mounted on its own cannot be replaced, only rewritten in place
+		log.Printf("Warning: could not replace %s atomically (%v), writing in place", path, err)
+		return os.WriteFile(path, data, perm)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	// BundleSchemaVersion is the bundle format written by ExportBundle
+	BundleSchemaVersion = 1
+
+	// SecretPlaceholder replaces every secret in an exported bundle
+	SecretPlaceholder = "<secret>"
+)
+
+// Placeholder states reported by Bundle.Apply
+const (
+	PlaceholderProvided = "provided" // Filled from the secrets sent with the import
+	PlaceholderKept     = "kept"     // Not sent; the target's current value is kept
+	PlaceholderMissing  = "missing"  // Not sent and the target has no value
+)
+
+// Bundle is a portable export of the configuration for moving a setup
+// between environments. Secrets are replaced by SecretPlaceholder.
+type Bundle struct {
+	SchemaVersion int       `json:"schemaVersion"`
+	ExportedAt    time.Time `json:"exportedAt"`
+	ExportedBy    string    `json:"exportedBy,omitempty"`
+	Config        Config    `json:"config"`
+}
+
+// PlaceholderStatus tells how a secret placeholder is filled on import
+type PlaceholderStatus struct {
+	Field  string `json:"field"`
+	Status string `json:"status"`
+}
+
+// bundleMigrations upgrade a decoded bundle from schema version N to N+1
+var bundleMigrations = map[int]func(raw map[string]interface{}) map[string]interface{}{
+	// Version 0 is a bare config, e.g. the output of GET /api/config
+	0: func(raw map[string]interface{}) map[string]interface{} {
+		delete(raw, "sources")
+		return map[string]interface{}{"schemaVersion": 1, "config": raw}
+	},
+}
+
+// ExportBundle exports the current config. Secrets are replaced by
+// placeholders; secret references are kept since they hold no secret.
+func (m *Manager) ExportBundle(exportedBy string) Bundle {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	cfg := *m.config
+	cfg.Admin.Users = append([]AdminUser(nil), cfg.Admin.Users...)
+	for _, secret := range bundleSecrets(&cfg) {
+		if ref, ok := m.refs[secret.name]; ok && ref.resolved == *secret.value {
+			*secret.value = ref.ref
+		} else if *secret.value != "" {
+			*secret.value = SecretPlaceholder
+		}
+	}
+
+	return Bundle{
+		SchemaVersion: BundleSchemaVersion,
+		ExportedAt:    time.Now().UTC(),
+		ExportedBy:    exportedBy,
+		Config:        cfg,
+	}
+}
+
+// ParseBundle decodes a bundle, migrating older schema versions
+func ParseBundle(data []byte) (*Bundle, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid bundle: %w", err)
+	}
+
+	version := 0
+	if v, ok := raw["schemaVersion"].(float64); ok {
+		version = int(v)
+	}
+	if version > BundleSchemaVersion {
+		return nil, fmt.Errorf("bundle schema version %d is newer than supported (%d)", version, BundleSchemaVersion)
+	}
+	for ; version < BundleSchemaVersion; version++ {
+		migrate, ok := bundleMigrations[version]
+		if !ok {
+			return nil, fmt.Errorf("no migration for bundle schema version %d", version)
+		}
+		raw = migrate(raw)
+	}
+
+	migrated, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var b Bundle
+	if err := json.Unmarshal(migrated, &b); err != nil {
+		return nil, fmt.Errorf("invalid bundle: %w", err)
+	}
+	return &b, nil
+}
+
+// Apply returns the config the bundle produces on a target whose config
+// is current. Placeholders are filled from secrets (keyed by field, e.g.
+// "mqtt.password" or "admin.users.<name>.password"), otherwise the
+// target's value is kept.
+func (b *Bundle) Apply(current Config, secrets map[string]string) (Config, []PlaceholderStatus) {
+	cfg := b.Config
+	cfg.Admin.Users = append([]AdminUser(nil), cfg.Admin.Users...)
+
+	existing := make(map[string]string)
+	for _, secret := range bundleSecrets(&current) {
+		existing[secret.name] = *secret.value
+	}
+
+	statuses := []PlaceholderStatus{}
+	for _, secret := range bundleSecrets(&cfg) {
+		// Masked values come from bundles migrated from GET /api/config
+		if *secret.value != SecretPlaceholder && *secret.value != "********" {
+			continue
+		}
+		status := PlaceholderStatus{Field: secret.name}
+		if value, ok := secrets[secret.name]; ok {
+			*secret.value = value
+			status.Status = PlaceholderProvided
+		} else if value := existing[secret.name]; value != "" {
+			*secret.value = value
+			status.Status = PlaceholderKept
+		} else {
+			*secret.value = ""
+			status.Status = PlaceholderMissing
+		}
+		statuses = append(statuses, status)
+	}
+	return cfg, statuses
+}
+
+// bundleSecrets returns every secret of cfg, admin passwords included
+func bundleSecrets(cfg *Config) []secretField {
+	fields := append(secretFields(cfg), secretField{"admin.password", &cfg.Admin.Password})
+	for i := range cfg.Admin.Users {
+		name := fmt.Sprintf("admin.users.%s.password", cfg.Admin.Users[i].Username)
+		fields = append(fields, secretField{name, &cfg.Admin.Users[i].Password})
+	}
+	return fields
+}
@@ -1,5 +1,7 @@
 package config
 
+import "github.com/omnipoll/backend/internal/payload"
+
 // Config holds all configuration for Omnipoll
 type Config struct {
 	SQLServer SQLServerConfig `json:"sqlServer" yaml:"sqlServer"`
@@ -7,6 +9,8 @@ type Config struct {
 	MongoDB   MongoDBConfig   `json:"mongodb" yaml:"mongodb"`
 	Polling   PollingConfig   `json:"polling" yaml:"polling"`
 	Admin     AdminConfig     `json:"admin" yaml:"admin"`
+	Tracing   TracingConfig   `json:"tracing" yaml:"tracing"`
+	Health    HealthConfig    `json:"health" yaml:"health"`
 }
 
 type SQLServerConfig struct {
@@ -20,13 +24,103 @@ type SQLServerConfig struct {
 type MQTTConfig struct {
 	Broker      string `json:"broker" yaml:"broker"`
 	Port        int    `json:"port" yaml:"port"`
-	Topic       string `json:"topic" yaml:"topic"`
+	Topic       string `json:"topic" yaml:"topic"`             // Not used for publishing, see TopicTemplate
 	TopicPrefix string `json:"topicPrefix" yaml:"topicPrefix"` // e.g., "feeding/mowi"
 	ClientID    string `json:"clientId" yaml:"clientId"`
 	User        string `json:"user" yaml:"user"`
 	Password    string `json:"password" yaml:"password"` // Encrypted at rest
 	QoS         byte   `json:"qos" yaml:"qos"`
 	UseTLS      bool   `json:"useTLS" yaml:"useTLS"`
+
+	// TopicTemplate builds the topic from event fields, e.g.
+	// "{prefix}/{centro|slug}/{jaula|digits}/feeding". Empty keeps the
+	// "{topicPrefix}/{centro}/" layout.
+	TopicTemplate string `json:"topicTemplate" yaml:"topicTemplate"`
+
+	// PayloadProfiles are the payload shapes published for every event,
+	// each to its own topic. Empty publishes the built-in "legacy" profile.
+	PayloadProfiles []payload.Profile `json:"payloadProfiles" yaml:"payloadProfiles"`
+
+	// Batching packs events for the same topic into one array
+	// message; MaxInFlight publishes several topics concurrently and
+	// bounds the unacknowledged QoS 1/2 messages. Order within a topic is
+	// always kept.
+	BatchMaxEvents int `json:"batchMaxEvents" yaml:"batchMaxEvents"` // 0 or 1 = one message per event
+	BatchMaxBytes  int `json:"batchMaxBytes" yaml:"batchMaxBytes"`   // 0 = 256 KiB
+	MaxInFlight    int `json:"maxInFlight" yaml:"maxInFlight"`       // 0 or 1 = sequential
+
+	// Rate limits of the broker connection, as token buckets with one
+	// second of burst. They pace every publish, so a backfill does not
+	// flood the broker. 0 = unlimited.
+	RateLimitMessages int `json:"rateLimitMessages" yaml:"rateLimitMessages"` // Messages per second
+	RateLimitBytes    int `json:"rateLimitBytes" yaml:"rateLimitBytes"`       // Payload bytes per second
+
+	// Mode is "events" (default, payload profiles) or "sparkplug":
+	// Sparkplug B with each centro as an edge node and each jaula as a
+	// device. Topic templates, payload profiles and batching do not apply.
+	Mode             string `json:"mode" yaml:"mode"`
+	SparkplugGroupID string `json:"sparkplugGroupId" yaml:"sparkplugGroupId"` // Default "omnipoll"
+
+	// StateTopic enables a retained latest-state message per jaula,
+	// updated after each batch, e.g. "{prefix}/state/{centro|slug}/{jaula|digits}".
+	// It may only use {prefix}, {centro} and {jaula}. Empty disables it.
+	StateTopic string `json:"stateTopic" yaml:"stateTopic"`
+
+	// HeartbeatIntervalSec is how often the retained "online" status on
+	// {topicPrefix}/status is refreshed; 0 = 30s. An "offline" Last Will
+	// replaces it when Omnipoll disappears.
+	HeartbeatIntervalSec int `json:"heartbeatIntervalSec" yaml:"heartbeatIntervalSec"`
+
+	// CommandsEnabled subscribes to {topicPrefix}/cmd/# for remote
+	// control (start, stop, poll-now, replay, status). Commands carry an
+	// API key; replies go to {topicPrefix}/reply/{command}.
+	CommandsEnabled bool `json:"commandsEnabled" yaml:"commandsEnabled"`
+
+	// OutboxMaxEvents bounds the events held for a broker that is down
+	// or slow; polling pauses while an outbox is full. 0 = 10000.
+	OutboxMaxEvents int `json:"outboxMaxEvents" yaml:"outboxMaxEvents"`
+
+	// Outputs are further brokers every event is also published to, each
+	// with its own connection, topics, QoS, payload profiles and outbox.
+	// The settings above are the "primary" output.
+	Outputs []MQTTOutput `json:"outputs" yaml:"outputs"`
+
+	// Transport is "tcp" (default), "ws" or "wss" (MQTT over WebSocket)
+	Transport string `json:"transport" yaml:"transport"`
+	WSPath    string `json:"wsPath" yaml:"wsPath"` // WebSocket path, default "/mqtt"
+
+	// TLS options, used for ssl:// and wss://. Certificates and the key
+	// are file paths or inline PEM.
+	TLSCA                 string `json:"tlsCa" yaml:"tlsCa"` // Trusted in addition to the system roots
+	TLSClientCert         string `json:"tlsClientCert" yaml:"tlsClientCert"`
+	TLSClientKey          string `json:"tlsClientKey" yaml:"tlsClientKey"` // Encrypted at rest
+	TLSServerName         string `json:"tlsServerName" yaml:"tlsServerName"`
+	TLSMinVersion         string `json:"tlsMinVersion" yaml:"tlsMinVersion"` // "1.2" (default) or "1.3"
+	TLSInsecureSkipVerify bool   `json:"tlsInsecureSkipVerify" yaml:"tlsInsecureSkipVerify"`
+
+	// ProtocolVersion is "3.1.1" (default) or "5". MQTT 5 adds content
+	// type, message expiry, user properties and topic aliases.
+	ProtocolVersion   string `json:"protocolVersion" yaml:"protocolVersion"`
+	MessageExpirySec  int    `json:"messageExpirySec" yaml:"messageExpirySec"`   // MQTT 5, 0 = never expires
+	ResponseTopic     string `json:"responseTopic" yaml:"responseTopic"`         // MQTT 5, optional
+	TopicAliasMaximum int    `json:"topicAliasMaximum" yaml:"topicAliasMaximum"` // MQTT 5, 0 disables topic aliases
+}
+
+// PrimaryOutput names the broker of the mqtt section itself
+const PrimaryOutput = "primary"
+
+// MQTTOutput is an additional broker. It takes every mqtt setting except
+// outputs; none are inherited from the primary broker.
+type MQTTOutput struct {
+	Name       string `json:"name" yaml:"name"`
+	MQTTConfig `yaml:",inline"`
+}
+
+// AllOutputs returns the primary broker followed by mqtt.outputs
+func (c MQTTConfig) AllOutputs() []MQTTOutput {
+	primary := c
+	primary.Outputs = nil
+	return append([]MQTTOutput{{Name: PrimaryOutput, MQTTConfig: primary}}, c.Outputs...)
 }
 
 type MongoDBConfig struct {
@@ -41,8 +135,36 @@ type PollingConfig struct {
 }
 
 type AdminConfig struct {
-	Host     string `json:"host" yaml:"host"`
-	Port     int    `json:"port" yaml:"port"`
+	Host     string      `json:"host" yaml:"host"`
+	Port     int         `json:"port" yaml:"port"`
+	Username string      `json:"username" yaml:"username"` // Legacy single user, always has the admin role
+	Password string      `json:"password" yaml:"password"` // Stored as a bcrypt hash
+	Users    []AdminUser `json:"users" yaml:"users"`
+
+	SessionTTLMinutes int `json:"sessionTtlMinutes" yaml:"sessionTtlMinutes"`
+	MaxLoginAttempts  int `json:"maxLoginAttempts" yaml:"maxLoginAttempts"` // Failures before lockout
+	LockoutMinutes    int `json:"lockoutMinutes" yaml:"lockoutMinutes"`
+}
+
+// AdminUser is an admin panel account with a role
+type AdminUser struct {
 	Username string `json:"username" yaml:"username"`
-	Password string `json:"password" yaml:"password"` // Encrypted at rest
+	Password string `json:"password" yaml:"password"` // Stored as a bcrypt hash
+	Role     string `json:"role" yaml:"role"`         // "viewer", "operator" or "admin"
+}
+
+type TracingConfig struct {
+	Enabled     bool     `json:"enabled" yaml:"enabled"`
+	Exporter    string   `json:"exporter" yaml:"exporter"` // "otlp" or "stdout"
+	Endpoint    string   `json:"endpoint" yaml:"endpoint"` // OTLP/HTTP collector, e.g. "localhost:4318"
+	Insecure    bool     `json:"insecure" yaml:"insecure"` // Plain HTTP to the collector
+	ServiceName string   `json:"serviceName" yaml:"serviceName"`
+	SampleRatio *float64 `json:"sampleRatio" yaml:"sampleRatio"` // 0..1, 0 = never; unset samples everything
+}
+
+type HealthConfig struct {
+	// RequiredDependencies lists the backends /readyz must reach: "sqlServer", "mqtt", "mongodb"
+	RequiredDependencies []string `json:"requiredDependencies" yaml:"requiredDependencies"`
+	RequireWorker        bool     `json:"requireWorker" yaml:"requireWorker"`
+	MaxWatermarkLagSec   int      `json:"maxWatermarkLagSec" yaml:"maxWatermarkLagSec"` // 0 disables the lag check
 }
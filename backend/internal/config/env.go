@@ -0,0 +1,168 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// EnvPrefix starts every config override variable, e.g. OMNIPOLL_MQTT_BROKER
+const EnvPrefix = "OMNIPOLL_"
+
+// Value sources reported by Manager.Sources
+const (
+	SourceFile = "file"
+	SourceEnv  = "env"
+)
+
+// ValueSource tells where the effective value of a config field comes from
+type ValueSource struct {
+	Source   string `json:"source"`             // "file" or "env"
+	Variable string `json:"variable,omitempty"` // Environment variable, for "env"
+}
+
+// envOverride is a config field set from the environment
+type envOverride struct {
+	variable  string
+	fileValue interface{} // Value from the file, written back on save
+	value     interface{} // Effective value after processing
+}
+
+// configField is a leaf of the config, addressed as "section.field"
+type configField struct {
+	path  string
+	env   string // Empty when the field cannot be set from the environment
+	value reflect.Value
+}
+
+// configFields lists every field of cfg. Variable names are derived from
+// the YAML keys: mqtt.clientId -> OMNIPOLL_MQTT_CLIENT_ID.
+func configFields(cfg *Config) []configField {
+	var fields []configField
+	root := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < root.NumField(); i++ {
+		section := root.Type().Field(i)
+		sectionKey := yamlKey(section)
+		sectionValue := root.Field(i)
+		for j := 0; j < sectionValue.NumField(); j++ {
+			field := sectionValue.Type().Field(j)
+			key := yamlKey(field)
+			f := configField{
+				path:  sectionKey + "." + key,
+				value: sectionValue.Field(j),
+			}
+			if envSettable(f.value) {
+				f.env = EnvPrefix + envName(sectionKey) + "_" + envName(key)
+			}
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+func yamlKey(f reflect.StructField) string {
+	key, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	if key == "" {
+		return strings.ToLower(f.Name)
+	}
+	return key
+}
+
+// envName converts a camelCase key to upper snake case (useTLS -> USE_TLS)
+func envName(key string) string {
+	var b strings.Builder
+	runes := []rune(key)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && !unicode.IsUpper(runes[i-1]) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// envSettable reports whether a field's type can be parsed from a variable
+func envSettable(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Uint8, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return v.Type().Elem().Kind() == reflect.String
+	case reflect.Pointer:
+		return envSettable(reflect.New(v.Type().Elem()).Elem())
+	}
+	return false
+}
+
+// setFromEnv parses raw into the field. Lists are comma-separated.
+func setFromEnv(v reflect.Value, raw string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.ParseInt(raw, 10, 0)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint8:
+		n, err := strconv.ParseUint(raw, 10, 8)
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		list := []string{}
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	case reflect.Pointer:
+		p := reflect.New(v.Type().Elem())
+		if err := setFromEnv(p.Elem(), raw); err != nil {
+			return err
+		}
+		v.Set(p)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// applyEnvOverrides sets every field that has an OMNIPOLL_SECTION_FIELD
+// variable and returns the overrides by field path
+func applyEnvOverrides(cfg *Config) (map[string]envOverride, error) {
+	overrides := make(map[string]envOverride)
+	for _, f := range configFields(cfg) {
+		if f.env == "" {
+			continue
+		}
+		raw, ok := os.LookupEnv(f.env)
+		if !ok {
+			continue
+		}
+		fileValue := f.value.Interface()
+		if err := setFromEnv(f.value, raw); err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", f.env, err)
+		}
+		overrides[f.path] = envOverride{variable: f.env, fileValue: fileValue}
+	}
+	return overrides, nil
+}
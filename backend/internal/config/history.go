@@ -0,0 +1,218 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HistoryPathEnv = "OMNIPOLL_CONFIG_HISTORY_PATH"
+
+	// maxVersions is how many saved configs are kept before the oldest are pruned
+	maxVersions = 100
+)
+
+// ErrVersionNotFound is returned for a config version that does not exist
+var ErrVersionNotFound = errors.New("config version not found")
+
+// Version describes a saved config version
+type Version struct {
+	Number    int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	Author    string    `json:"author"`
+	Comment   string    `json:"comment,omitempty"`
+}
+
+// storedVersion is a version file: the config file exactly as it was
+// written, so secrets stay encrypted
+type storedVersion struct {
+	Version
+	Data string `json:"data"`
+}
+
+// history keeps every saved config as a numbered file in a directory
+type history struct {
+	dir string
+}
+
+func newHistory(configPath string) *history {
+	dir := os.Getenv(HistoryPathEnv)
+	if dir == "" {
+		dir = filepath.Join(filepath.Dir(configPath), "config-history")
+	}
+	return &history{dir: dir}
+}
+
+func (h *history) file(number int) string {
+	return filepath.Join(h.dir, fmt.Sprintf("%06d.json", number))
+}
+
+// numbers returns the stored version numbers in ascending order
+func (h *history) numbers() ([]int, error) {
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var numbers []int
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".json")
+		if n, err := strconv.Atoi(name); err == nil && name != e.Name() {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	return numbers, nil
+}
+
+// record stores data as a new version and prunes old ones
+func (h *history) record(data []byte, author, comment string) (Version, error) {
+	numbers, err := h.numbers()
+	if err != nil {
+		return Version{}, err
+	}
+	next := 1
+	if len(numbers) > 0 {
+		next = numbers[len(numbers)-1] + 1
+	}
+
+	v := storedVersion{
+		Version: Version{
+			Number:    next,
+			CreatedAt: time.Now().UTC(),
+			Author:    author,
+			Comment:   comment,
+		},
+		Data: string(data),
+	}
+	encoded, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return Version{}, err
+	}
+	if err := os.MkdirAll(h.dir, 0700); err != nil {
+		return Version{}, err
+	}
+	if err := writeFileAtomic(h.file(next), encoded, 0600); err != nil {
+		return Version{}, err
+	}
+
+	numbers = append(numbers, next)
+	for len(numbers) > maxVersions {
+		if err := os.Remove(h.file(numbers[0])); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: could not prune config version %d: %v", numbers[0], err)
+		}
+		numbers = numbers[1:]
+	}
+	return v.Version, nil
+}
+
+// load reads a single version
+func (h *history) load(number int) (*storedVersion, error) {
+	data, err := os.ReadFile(h.file(number))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %d", ErrVersionNotFound, number)
+		}
+		return nil, err
+	}
+	var v storedVersion
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("invalid config version %d: %w", number, err)
+	}
+	return &v, nil
+}
+
+// rewrite passes the data of every version through fn and stores the
+// versions it changed, returning how many were rewritten
+func (h *history) rewrite(fn func(data string) (string, error)) (int, error) {
+	numbers, err := h.numbers()
+	if err != nil {
+		return 0, err
+	}
+	rewritten := 0
+	for _, n := range numbers {
+		v, err := h.load(n)
+		if err != nil {
+			return rewritten, err
+		}
+		data, err := fn(v.Data)
+		if err != nil {
+			return rewritten, fmt.Errorf("config version %d: %w", n, err)
+		}
+		if data == v.Data {
+			continue
+		}
+		v.Data = data
+		encoded, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return rewritten, err
+		}
+		if err := writeFileAtomic(h.file(n), encoded, 0600); err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+	return rewritten, nil
+}
+
+// list returns the metadata of every version, newest first
+func (h *history) list() ([]Version, error) {
+	numbers, err := h.numbers()
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]Version, 0, len(numbers))
+	for i := len(numbers) - 1; i >= 0; i-- {
+		v, err := h.load(numbers[i])
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v.Version)
+	}
+	return versions, nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over
+// path, so readers and crashes never see a half-written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		// A file bind-mounted on its own (as in docker-compose) cannot be
+		// replaced, only rewritten in place
+		log.Printf("Warning: could not replace %s atomically (%v), writing in place", path, err)
+		return os.WriteFile(path, data, perm)
+	}
+	return nil
+}
@@ -1,30 +1,65 @@
 package config
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/omnipoll/backend/internal/crypto"
+	"github.com/omnipoll/backend/internal/secrets"
 	"gopkg.in/yaml.v3"
 )
 
 const (
 	ConfigPathEnv     = "OMNIPOLL_CONFIG_PATH"
 	DefaultConfigPath = "./data/config.yaml"
+
+	// ModeEnv selects the runtime mode; "production" enables strict checks
+	ModeEnv = "OMNIPOLL_ENV"
 )
 
+// IsProduction reports whether Omnipoll runs in production mode
+func IsProduction() bool {
+	return strings.EqualFold(os.Getenv(ModeEnv), "production")
+}
+
 // Manager handles configuration loading, saving, and encryption
 type Manager struct {
 	mu        sync.RWMutex
+	updateMu  sync.Mutex // Serializes read-modify-write updates
 	config    *Config
 	path      string
 	encryptor *crypto.Encryptor
+	resolver  *secrets.Resolver
+	refs      map[string]secretRef   // Secret fields loaded from a reference, by field name
+	overrides map[string]envOverride // Fields set from OMNIPOLL_* variables, by field path
+	history   *history
+}
+
+// secretRef remembers which reference a secret was resolved from, so the
+// reference (not the secret) is written back on save
+type secretRef struct {
+	ref      string
+	resolved string
 }
 
 // NewManager creates a new configuration manager
 func NewManager() (*Manager, error) {
+	if os.Getenv(crypto.MasterKeyEnv) == "" {
+		if IsProduction() {
+			return nil, fmt.Errorf("%s must be set when %s=production", crypto.MasterKeyEnv, ModeEnv)
+		}
+		log.Printf("Warning: %s not set, secrets are encrypted with the development key", crypto.MasterKeyEnv)
+	}
+
 	encryptor, err := crypto.NewEncryptor()
 	if err != nil {
 		return nil, err
@@ -38,6 +73,10 @@ func NewManager() (*Manager, error) {
 	m := &Manager{
 		path:      path,
 		encryptor: encryptor,
+		resolver:  secrets.NewResolver(),
+		refs:      make(map[string]secretRef),
+		overrides: make(map[string]envOverride),
+		history:   newHistory(path),
 		config:    DefaultConfig(),
 	}
 
@@ -46,6 +85,7 @@ func NewManager() (*Manager, error) {
 
 // DefaultConfig returns a configuration with sensible defaults
 func DefaultConfig() *Config {
+	sampleAll := 1.0
 	return &Config{
 		SQLServer: SQLServerConfig{
 			Host:     "localhost",
@@ -75,6 +115,23 @@ func DefaultConfig() *Config {
 			Port:     8080,
 			Username: "admin",
 			Password: "admin",
+
+			SessionTTLMinutes: 480,
+			MaxLoginAttempts:  5,
+			LockoutMinutes:    15,
+		},
+		Tracing: TracingConfig{
+			Enabled:     false,
+			Exporter:    "otlp",
+			Endpoint:    "localhost:4318",
+			Insecure:    true,
+			ServiceName: "omnipoll",
+			SampleRatio: &sampleAll,
+		},
+		Health: HealthConfig{
+			RequiredDependencies: []string{"sqlServer", "mqtt", "mongodb"},
+			RequireWorker:        true,
+			MaxWatermarkLagSec:   0,
 		},
 	}
 }
@@ -83,94 +140,286 @@ func DefaultConfig() *Config {
 func (m *Manager) Load() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	return m.loadUnlocked()
+}
 
+func (m *Manager) loadUnlocked() error {
 	data, err := os.ReadFile(m.path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			// Create default config if it doesn't exist
-			return m.saveUnlocked()
+			cfg := DefaultConfig()
+			if _, err := hashAdminPasswords(cfg); err != nil {
+				return err
+			}
+			overrides, err := m.applyOverrides(cfg, nil)
+			if err != nil {
+				return err
+			}
+			if err := cfg.Validate(); err != nil {
+				return err
+			}
+			m.config = cfg
+			m.refs = make(map[string]secretRef)
+			m.overrides = overrides
+			return m.saveUnlocked(systemAuthor, "default config created")
 		}
 		return err
 	}
 
-	ext := filepath.Ext(m.path)
 	var cfg Config
+	if err := unmarshalConfig(m.path, data, &cfg); err != nil {
+		return err
+	}
 
-	switch ext {
-	case ".yaml", ".yml":
-		if err := yaml.Unmarshal(data, &cfg); err != nil {
-			return err
+	// Resolve secret references and decrypt the rest. Secrets still in
+	// plain text in the file get encrypted below.
+	refs, err := m.resolveReferences(&cfg)
+	if err != nil {
+		return err
+	}
+
+	needsSave := false
+	for _, secret := range secretFields(&cfg) {
+		if _, isRef := refs[secret.name]; isRef {
+			continue
 		}
-	case ".json":
-		if err := json.Unmarshal(data, &cfg); err != nil {
+		if *secret.value != "" && !crypto.IsEncrypted(*secret.value) {
+			needsSave = true
+		}
+		if *secret.value, err = m.encryptor.Decrypt(*secret.value); err != nil {
 			return err
 		}
-	default:
-		// Try YAML first, then JSON
-		if err := yaml.Unmarshal(data, &cfg); err != nil {
-			if err := json.Unmarshal(data, &cfg); err != nil {
-				return err
-			}
+	}
+	if cfg.Admin.Password, err = m.encryptor.Decrypt(cfg.Admin.Password); err != nil {
+		return err
+	}
+	for i := range cfg.Admin.Users {
+		if cfg.Admin.Users[i].Password, err = m.encryptor.Decrypt(cfg.Admin.Users[i].Password); err != nil {
+			return err
 		}
 	}
 
-	// Decrypt passwords
-	if cfg.SQLServer.Password, err = m.encryptor.Decrypt(cfg.SQLServer.Password); err != nil {
+	// Upgrade plain-text admin passwords left in the file
+	changed, err := hashAdminPasswords(&cfg)
+	if err != nil {
 		return err
 	}
-	if cfg.MQTT.Password, err = m.encryptor.Decrypt(cfg.MQTT.Password); err != nil {
+
+	overrides, err := m.applyOverrides(&cfg, nil)
+	if err != nil {
 		return err
 	}
-	if cfg.Admin.Password, err = m.encryptor.Decrypt(cfg.Admin.Password); err != nil {
+	// Refuse to run with an invalid config rather than fail later
+	if err := cfg.Validate(); err != nil {
 		return err
 	}
-
 	m.config = &cfg
+	m.refs = refs
+	m.overrides = overrides
+
+	if changed || needsSave {
+		return m.saveUnlocked(systemAuthor, "secrets encrypted on load")
+	}
+
+	// Keep the file as it was before the first change made through Omnipoll
+	if numbers, err := m.history.numbers(); err == nil && len(numbers) == 0 {
+		if _, err := m.history.record(data, systemAuthor, "initial version"); err != nil {
+			log.Printf("Warning: could not record config version: %v", err)
+		}
+	}
 	return nil
 }
 
+// applyOverrides layers OMNIPOLL_SECTION_FIELD variables on top of cfg,
+// whose secrets are already resolved and admin passwords hashed. A field
+// still at its effective value in prev keeps the file value from prev, so
+// saving an unchanged config never writes environment values to the file.
+func (m *Manager) applyOverrides(cfg *Config, prev map[string]envOverride) (map[string]envOverride, error) {
+	overrides, err := applyEnvOverrides(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Overridden secrets may be references themselves
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	for _, secret := range secretFields(cfg) {
+		if _, ok := overrides[secret.name]; !ok {
+			continue
+		}
+		if literal, ok := secrets.Literal(*secret.value); ok {
+			*secret.value = literal
+			continue
+		}
+		if !secrets.IsReference(*secret.value) {
+			continue
+		}
+		if *secret.value, err = m.resolver.Resolve(ctx, *secret.value); err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %w", secret.name, err)
+		}
+	}
+	if _, err := hashAdminPasswords(cfg); err != nil {
+		return nil, err
+	}
+
+	for _, f := range configFields(cfg) {
+		ov, ok := overrides[f.path]
+		if !ok {
+			continue
+		}
+		if p, ok := prev[f.path]; ok && reflect.DeepEqual(ov.fileValue, p.value) {
+			ov.fileValue = p.fileValue
+		}
+		ov.value = f.value.Interface()
+		overrides[f.path] = ov
+	}
+	return overrides, nil
+}
+
+// resolveReferences replaces secret references in cfg with their values
+// and returns the references by field name. Escaped literals lose their
+// "literal:" prefix and are kept as plain secrets.
+func (m *Manager) resolveReferences(cfg *Config) (map[string]secretRef, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	refs := make(map[string]secretRef)
+	for _, secret := range secretFields(cfg) {
+		if literal, ok := secrets.Literal(*secret.value); ok {
+			*secret.value = literal
+			continue
+		}
+		if !secrets.IsReference(*secret.value) {
+			continue
+		}
+		resolved, err := m.resolver.Resolve(ctx, *secret.value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %w", secret.name, err)
+		}
+		refs[secret.name] = secretRef{ref: *secret.value, resolved: resolved}
+		*secret.value = resolved
+	}
+	return refs, nil
+}
+
+// secretField is a config value that is encrypted at rest and may be
+// given as a secret reference (env:, file:, vault:)
+type secretField struct {
+	name  string
+	value *string
+}
+
+// secretFields returns the secret values of cfg.
+// Admin passwords are bcrypt hashes instead and are not listed. cfg gets
+// its own copy of mqtt.outputs, so the secrets of a shallow copy can be
+// changed without touching the original.
+func secretFields(cfg *Config) []secretField {
+	fields := []secretField{
+		{"sqlServer.password", &cfg.SQLServer.Password},
+		{"mqtt.password", &cfg.MQTT.Password},
+		{"mqtt.tlsClientKey", &cfg.MQTT.TLSClientKey},
+	}
+	if len(cfg.MQTT.Outputs) == 0 {
+		return fields
+	}
+	cfg.MQTT.Outputs = append([]MQTTOutput(nil), cfg.MQTT.Outputs...)
+	for i := range cfg.MQTT.Outputs {
+		out := &cfg.MQTT.Outputs[i]
+		fields = append(fields,
+			secretField{"mqtt.outputs." + out.Name + ".password", &out.Password},
+			secretField{"mqtt.outputs." + out.Name + ".tlsClientKey", &out.TLSClientKey},
+		)
+	}
+	return fields
+}
+
+// unmarshalConfig decodes YAML or JSON depending on the file extension
+func unmarshalConfig(path string, data []byte, cfg *Config) error {
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		return yaml.Unmarshal(data, cfg)
+	case ".json":
+		return json.Unmarshal(data, cfg)
+	default:
+		// Try YAML first, then JSON
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return json.Unmarshal(data, cfg)
+		}
+		return nil
+	}
+}
+
+// hashAdminPasswords replaces plain-text admin passwords with bcrypt hashes
+func hashAdminPasswords(cfg *Config) (bool, error) {
+	changed := false
+	hash := func(pw *string) error {
+		if *pw == "" || crypto.IsPasswordHash(*pw) {
+			return nil
+		}
+		hashed, err := crypto.HashPassword(*pw)
+		if err != nil {
+			return err
+		}
+		*pw = hashed
+		changed = true
+		return nil
+	}
+
+	if err := hash(&cfg.Admin.Password); err != nil {
+		return false, err
+	}
+	// Copy so the caller's slice is not modified
+	cfg.Admin.Users = append([]AdminUser(nil), cfg.Admin.Users...)
+	for i := range cfg.Admin.Users {
+		if err := hash(&cfg.Admin.Users[i].Password); err != nil {
+			return false, err
+		}
+	}
+	return changed, nil
+}
+
+// systemAuthor is the author of versions saved by Omnipoll itself
+const systemAuthor = "system"
+
 // Save writes the configuration to file with encrypted passwords
 func (m *Manager) Save() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	return m.saveUnlocked()
+	return m.saveUnlocked(systemAuthor, "")
 }
 
-func (m *Manager) saveUnlocked() error {
+// saveUnlocked writes the config file atomically and records it as a new version
+func (m *Manager) saveUnlocked(author, comment string) error {
 	// Create directory if it doesn't exist
 	dir := filepath.Dir(m.path)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return err
 	}
 
-	// Create a copy with encrypted passwords
+	// Create a copy with encrypted secrets. Environment overrides are
+	// replaced by the file value, and values that came from a secret
+	// reference are written back as the reference.
 	cfg := *m.config
-
-	// NOTE: Encryption disabled for development
-	// Passwords are stored in plain text in development
-	// TODO: Enable encryption in production
-	
-	/*
-	var err error
-	if !crypto.IsEncrypted(cfg.SQLServer.Password) && cfg.SQLServer.Password != "" {
-		cfg.SQLServer.Password, err = m.encryptor.Encrypt(cfg.SQLServer.Password)
-		if err != nil {
-			return err
+	for _, f := range configFields(&cfg) {
+		if ov, ok := m.overrides[f.path]; ok && reflect.DeepEqual(f.value.Interface(), ov.value) {
+			f.value.Set(reflect.ValueOf(ov.fileValue))
 		}
 	}
-	if !crypto.IsEncrypted(cfg.MQTT.Password) && cfg.MQTT.Password != "" {
-		cfg.MQTT.Password, err = m.encryptor.Encrypt(cfg.MQTT.Password)
-		if err != nil {
-			return err
+	for _, secret := range secretFields(&cfg) {
+		if ref, ok := m.refs[secret.name]; ok && *secret.value == ref.resolved {
+			*secret.value = ref.ref
+			continue
 		}
-	}
-	if !crypto.IsEncrypted(cfg.Admin.Password) && cfg.Admin.Password != "" {
-		cfg.Admin.Password, err = m.encryptor.Encrypt(cfg.Admin.Password)
+		if *secret.value == "" || crypto.IsEncrypted(*secret.value) {
+			continue
+		}
+		encrypted, err := m.encryptor.Encrypt(*secret.value)
 		if err != nil {
 			return err
 		}
+		*secret.value = encrypted
 	}
-	*/
 
 	ext := filepath.Ext(m.path)
 	var data []byte
@@ -186,7 +435,118 @@ func (m *Manager) saveUnlocked() error {
 		return err
 	}
 
-	return os.WriteFile(m.path, data, 0600)
+	if err := writeFileAtomic(m.path, data, 0600); err != nil {
+		return err
+	}
+	// The config itself is saved; a missing version is not worth failing for
+	if _, err := m.history.record(data, author, comment); err != nil {
+		log.Printf("Warning: could not record config version: %v", err)
+	}
+	return nil
+}
+
+// RotateKeys re-encrypts every secret in the config file and in the saved
+// config versions with the active master key and returns how many secrets
+// were rewritten. A retired key can be dropped from
+// OMNIPOLL_PREVIOUS_MASTER_KEYS only once rotation has succeeded, as
+// versions it could not re-encrypt still need it.
+func (m *Manager) RotateKeys() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		return 0, err
+	}
+	var raw Config
+	if err := unmarshalConfig(m.path, data, &raw); err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	for _, secret := range secretFields(&raw) {
+		value := *secret.value
+		if value == "" || secrets.IsReference(value) {
+			continue
+		}
+		if !crypto.IsEncrypted(value) || m.encryptor.NeedsRotation(value) {
+			rotated++
+		}
+	}
+
+	if err := m.loadUnlocked(); err != nil {
+		return 0, err
+	}
+
+	// Load holds plain-text secrets in memory; saving encrypts them with the active key
+	if err := m.saveUnlocked(systemAuthor, "master key rotation"); err != nil {
+		return 0, err
+	}
+
+	// Versions keep the file as it was written, so their secrets are
+	// rewritten in place rather than re-marshalled
+	if _, err := m.history.rewrite(func(data string) (string, error) {
+		var rotateErr error
+		data = encryptedValue.ReplaceAllStringFunc(data, func(value string) string {
+			if rotateErr != nil || !m.encryptor.NeedsRotation(value) {
+				return value
+			}
+			plain, err := m.encryptor.Decrypt(value)
+			if err != nil {
+				rotateErr = err
+				return value
+			}
+			encrypted, err := m.encryptor.Encrypt(plain)
+			if err != nil {
+				rotateErr = err
+				return value
+			}
+			rotated++
+			return encrypted
+		})
+		return data, rotateErr
+	}); err != nil {
+		return rotated, fmt.Errorf("config rotated, but saved versions were not: %w", err)
+	}
+	return rotated, nil
+}
+
+// encryptedValue matches an encrypted secret ("encrypted:[<keyID>:]<base64>")
+var encryptedValue = regexp.MustCompile(regexp.QuoteMeta(crypto.EncryptedPrefix) + `(?:[0-9a-f]+:)?[A-Za-z0-9+/]+=*`)
+
+// SecretReferences returns the reference each secret field was loaded from
+func (m *Manager) SecretReferences() map[string]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	refs := make(map[string]string, len(m.refs))
+	for name, ref := range m.refs {
+		refs[name] = ref.ref
+	}
+	return refs
+}
+
+// Sources reports, for every "section.field", whether its effective value
+// comes from the config file or an environment variable
+func (m *Manager) Sources() map[string]ValueSource {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	cfg := *m.config
+	sources := make(map[string]ValueSource)
+	for _, f := range configFields(&cfg) {
+		if ov, ok := m.overrides[f.path]; ok {
+			sources[f.path] = ValueSource{Source: SourceEnv, Variable: ov.variable}
+		} else {
+			sources[f.path] = ValueSource{Source: SourceFile}
+		}
+	}
+	return sources
+}
+
+// ActiveKeyID returns the ID of the master key used for new secrets
+func (m *Manager) ActiveKeyID() string {
+	return m.encryptor.ActiveKeyID()
 }
 
 // Get returns the current configuration (read-only copy)
@@ -196,12 +556,109 @@ func (m *Manager) Get() Config {
 	return *m.config
 }
 
-// Update updates the configuration
-func (m *Manager) Update(cfg Config) error {
+// Update updates the configuration and records it as a new version by
+// author. An invalid cfg is rejected with ValidationErrors and nothing is saved.
+func (m *Manager) Update(cfg Config, author, comment string) error {
+	m.updateMu.Lock()
+	defer m.updateMu.Unlock()
+	return m.update(cfg, author, comment)
+}
+
+// Modify applies fn to a copy of the current config and saves the result
+// like Update. No other update can happen between reading and saving.
+func (m *Manager) Modify(fn func(cfg *Config) error, author, comment string) error {
+	m.updateMu.Lock()
+	defer m.updateMu.Unlock()
+
+	cfg := m.Get()
+	if err := fn(&cfg); err != nil {
+		return err
+	}
+	return m.update(cfg, author, comment)
+}
+
+func (m *Manager) update(cfg Config, author, comment string) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if _, err := hashAdminPasswords(&cfg); err != nil {
+		return err
+	}
+	newRefs, err := m.resolveReferences(&cfg)
+	if err != nil {
+		return err
+	}
+
 	m.mu.Lock()
+	// Keep references whose resolved value was left untouched
+	for _, secret := range secretFields(&cfg) {
+		if ref, ok := m.refs[secret.name]; ok && ref.resolved == *secret.value {
+			if _, replaced := newRefs[secret.name]; !replaced {
+				newRefs[secret.name] = ref
+			}
+		}
+	}
+	overrides, err := m.applyOverrides(&cfg, m.overrides)
+	if err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	m.refs = newRefs
+	m.overrides = overrides
 	m.config = &cfg
-	m.mu.Unlock()
-	return m.Save()
+	defer m.mu.Unlock()
+	return m.saveUnlocked(author, comment)
+}
+
+// Versions lists the saved config versions, newest first
+func (m *Manager) Versions() ([]Version, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.history.list()
+}
+
+// VersionConfig returns a saved config version with its secrets decrypted.
+// Secret references are returned as references.
+func (m *Manager) VersionConfig(number int) (Config, Version, error) {
+	m.mu.RLock()
+	stored, err := m.history.load(number)
+	m.mu.RUnlock()
+	if err != nil {
+		return Config{}, Version{}, err
+	}
+
+	var cfg Config
+	if err := unmarshalConfig(m.path, []byte(stored.Data), &cfg); err != nil {
+		return Config{}, Version{}, fmt.Errorf("invalid config version %d: %w", number, err)
+	}
+	for _, secret := range secretFields(&cfg) {
+		if secrets.IsReference(*secret.value) {
+			continue
+		}
+		if *secret.value, err = m.encryptor.Decrypt(*secret.value); err != nil {
+			return Config{}, Version{}, fmt.Errorf("failed to decrypt %s of config version %d: %w", secret.name, number, err)
+		}
+	}
+	// Admin passwords are hashes, but very old files may have them encrypted
+	if cfg.Admin.Password, err = m.encryptor.Decrypt(cfg.Admin.Password); err != nil {
+		return Config{}, Version{}, err
+	}
+	for i := range cfg.Admin.Users {
+		if cfg.Admin.Users[i].Password, err = m.encryptor.Decrypt(cfg.Admin.Users[i].Password); err != nil {
+			return Config{}, Version{}, err
+		}
+	}
+	return cfg, stored.Version, nil
+}
+
+// Rollback restores a saved config version. The restored config is saved
+// as a new version, so a rollback can itself be rolled back.
+func (m *Manager) Rollback(number int, author string) error {
+	cfg, _, err := m.VersionConfig(number)
+	if err != nil {
+		return err
+	}
+	return m.Update(cfg, author, fmt.Sprintf("rollback to version %d", number))
 }
 
 // GetPath returns the configuration file path
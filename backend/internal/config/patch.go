@@ -0,0 +1,92 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+var (
+	// ErrUnknownSection is returned when patching a section Config does not have
+	ErrUnknownSection = errors.New("unknown config section")
+	// ErrInvalidPatch is returned for malformed patches and unknown fields
+	ErrInvalidPatch = errors.New("invalid patch")
+)
+
+// PatchSection applies a JSON Merge Patch (RFC 7396) to one section of
+// cfg, named by its JSON key ("mqtt", "sqlServer", ...). Members set to
+// null are cleared to their zero value; arrays are replaced as a whole.
+// Unknown fields are rejected.
+func PatchSection(cfg *Config, section string, patch []byte) error {
+	field, ok := sectionField(cfg, section)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownSection, section)
+	}
+
+	var p interface{}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+	if _, ok := p.(map[string]interface{}); !ok {
+		return fmt.Errorf("%w: a section patch must be a JSON object", ErrInvalidPatch)
+	}
+
+	current, err := json.Marshal(field.Interface())
+	if err != nil {
+		return err
+	}
+	var target interface{}
+	if err := json.Unmarshal(current, &target); err != nil {
+		return err
+	}
+
+	merged, err := json.Marshal(mergePatch(target, p))
+	if err != nil {
+		return err
+	}
+
+	// Decode into a zero value so cleared members end up zero
+	updated := reflect.New(field.Type())
+	dec := json.NewDecoder(bytes.NewReader(merged))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(updated.Interface()); err != nil {
+		return fmt.Errorf("%w for %s: %v", ErrInvalidPatch, section, err)
+	}
+	field.Set(updated.Elem())
+	return nil
+}
+
+// mergePatch implements the MergePatch function of RFC 7396
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+		} else {
+			t[key] = mergePatch(t[key], value)
+		}
+	}
+	return t
+}
+
+// sectionField returns the section of cfg whose JSON key is name
+func sectionField(cfg *Config, name string) (reflect.Value, bool) {
+	root := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < root.NumField(); i++ {
+		key, _, _ := strings.Cut(root.Type().Field(i).Tag.Get("json"), ",")
+		if key == name {
+			return root.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
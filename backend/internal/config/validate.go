@@ -0,0 +1,256 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/omnipoll/backend/internal/topic"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+)
+
+// FieldError is a validation failure for one config field
+type FieldError struct {
+	Field   string `json:"field"` // "section.field", as in the YAML file
+	Message string `json:"message"`
+}
+
+// ValidationErrors lists every invalid field of a config
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Field + ": " + fe.Message
+	}
+	return "invalid configuration: " + strings.Join(msgs, "; ")
+}
+
+// Validate checks the config and returns ValidationErrors if any field is invalid
+func (c *Config) Validate() error {
+	var errs ValidationErrors
+	add := func(field, format string, args ...interface{}) {
+		errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	required := func(field, value string) {
+		if strings.TrimSpace(value) == "" {
+			add(field, "is required")
+		}
+	}
+	port := func(field string, value int) {
+		if value < 1 || value > 65535 {
+			add(field, "must be between 1 and 65535, got %d", value)
+		}
+	}
+	nonNegative := func(field string, value int) {
+		if value < 0 {
+			add(field, "must not be negative, got %d", value)
+		}
+	}
+
+	required("sqlServer.host", c.SQLServer.Host)
+	port("sqlServer.port", c.SQLServer.Port)
+	required("sqlServer.database", c.SQLServer.Database)
+
+	// mqtt validates the settings of one broker, the primary or an output
+	mqtt := func(field string, m MQTTConfig) {
+		required(field+".broker", m.Broker)
+		port(field+".port", m.Port)
+		required(field+".clientId", m.ClientID)
+		if m.QoS > 2 {
+			add(field+".qos", "must be 0, 1 or 2, got %d", m.QoS)
+		}
+		switch m.Transport {
+		case "", "tcp", "ws", "wss":
+		default:
+			add(field+".transport", "must be \"tcp\", \"ws\" or \"wss\", got %q", m.Transport)
+		}
+		switch m.TLSMinVersion {
+		case "", "1.2", "1.3":
+		default:
+			add(field+".tlsMinVersion", "must be \"1.2\" or \"1.3\", got %q", m.TLSMinVersion)
+		}
+		if (m.TLSClientCert == "") != (m.TLSClientKey == "") {
+			add(field+".tlsClientCert", "client certificate and key must be set together")
+		}
+		if strings.ContainsAny(m.TopicPrefix, "+#") {
+			add(field+".topicPrefix", "must not contain the wildcards + or #")
+		}
+		if m.TopicTemplate != "" {
+			if _, err := topic.Parse(m.TopicTemplate); err != nil {
+				add(field+".topicTemplate", "%v", err)
+			}
+		}
+		if m.StateTopic != "" {
+			if err := validateStateTopic(m.StateTopic); err != nil {
+				add(field+".stateTopic", "%v", err)
+			}
+		}
+		profiles := make(map[string]bool)
+		for i, p := range m.PayloadProfiles {
+			field := fmt.Sprintf("%s.payloadProfiles.%d", field, i)
+			if err := p.Validate(); err != nil {
+				add(field, "%v", err)
+			} else if profiles[p.Name] {
+				add(field+".name", "duplicate profile %q", p.Name)
+			}
+			profiles[p.Name] = true
+		}
+		if m.BatchMaxEvents < 0 || m.BatchMaxEvents > 10000 {
+			add(field+".batchMaxEvents", "must be between 0 and 10000, got %d", m.BatchMaxEvents)
+		}
+		nonNegative(field+".batchMaxBytes", m.BatchMaxBytes)
+		if m.MaxInFlight < 0 || m.MaxInFlight > 1000 {
+			add(field+".maxInFlight", "must be between 0 and 1000, got %d", m.MaxInFlight)
+		}
+		nonNegative(field+".rateLimitMessages", m.RateLimitMessages)
+		nonNegative(field+".rateLimitBytes", m.RateLimitBytes)
+		if ob := m.OutboxMaxEvents; ob < 0 || ob > 1000000 {
+			add(field+".outboxMaxEvents", "must be between 0 and 1000000, got %d", ob)
+		}
+		if hb := m.HeartbeatIntervalSec; hb != 0 && (hb < 5 || hb > 3600) {
+			add(field+".heartbeatIntervalSec", "must be 0 (default) or between 5 and 3600, got %d", hb)
+		}
+		switch m.Mode {
+		case "", "events", "sparkplug":
+		default:
+			add(field+".mode", "must be \"events\" or \"sparkplug\", got %q", m.Mode)
+		}
+		if strings.ContainsAny(m.SparkplugGroupID, "+#/") {
+			add(field+".sparkplugGroupId", "must not contain +, # or /")
+		}
+		switch m.ProtocolVersion {
+		case "", "3.1.1", "5":
+		default:
+			add(field+".protocolVersion", "must be \"3.1.1\" or \"5\", got %q", m.ProtocolVersion)
+		}
+		nonNegative(field+".messageExpirySec", m.MessageExpirySec)
+		if m.TopicAliasMaximum < 0 || m.TopicAliasMaximum > 65535 {
+			add(field+".topicAliasMaximum", "must be between 0 and 65535, got %d", m.TopicAliasMaximum)
+		}
+		if strings.ContainsAny(m.ResponseTopic, "+#") {
+			add(field+".responseTopic", "must not contain the wildcards + or #")
+		}
+	}
+	mqtt("mqtt", c.MQTT)
+	outputs := make(map[string]bool)
+	clients := map[string]bool{brokerClient(c.MQTT): true}
+	for i, out := range c.MQTT.Outputs {
+		field := fmt.Sprintf("mqtt.outputs.%d", i)
+		if strings.TrimSpace(out.Name) == "" {
+			add(field+".name", "is required")
+		} else if out.Name == PrimaryOutput {
+			add(field+".name", "%q is reserved for the mqtt section itself", out.Name)
+		} else if outputs[out.Name] {
+			add(field+".name", "duplicate output %q", out.Name)
+		}
+		outputs[out.Name] = true
+		if len(out.Outputs) > 0 {
+			add(field+".outputs", "outputs cannot be nested")
+		}
+		if clients[brokerClient(out.MQTTConfig)] {
+			add(field+".clientId", "client ID %q is already used on %s:%d", out.ClientID, out.Broker, out.Port)
+		}
+		clients[brokerClient(out.MQTTConfig)] = true
+		mqtt(field, out.MQTTConfig)
+	}
+
+	if strings.TrimSpace(c.MongoDB.URI) == "" {
+		add("mongodb.uri", "is required")
+	} else if _, err := connstring.ParseAndValidate(c.MongoDB.URI); err != nil {
+		add("mongodb.uri", "is not a valid MongoDB connection string: %v", err)
+	}
+	required("mongodb.database", c.MongoDB.Database)
+	required("mongodb.collection", c.MongoDB.Collection)
+
+	if c.Polling.IntervalMS < 100 {
+		add("polling.intervalMs", "must be at least 100, got %d", c.Polling.IntervalMS)
+	}
+	if c.Polling.BatchSize < 1 || c.Polling.BatchSize > 10000 {
+		add("polling.batchSize", "must be between 1 and 10000, got %d", c.Polling.BatchSize)
+	}
+
+	required("admin.host", c.Admin.Host)
+	port("admin.port", c.Admin.Port)
+	// The legacy account is optional, but there must be some account
+	if strings.TrimSpace(c.Admin.Username) != "" {
+		required("admin.password", c.Admin.Password)
+	} else if c.Admin.Password != "" {
+		add("admin.username", "is required when admin.password is set")
+	} else if len(c.Admin.Users) == 0 {
+		add("admin.username", "is required when admin.users is empty")
+	}
+	nonNegative("admin.sessionTtlMinutes", c.Admin.SessionTTLMinutes)
+	nonNegative("admin.maxLoginAttempts", c.Admin.MaxLoginAttempts)
+	nonNegative("admin.lockoutMinutes", c.Admin.LockoutMinutes)
+	seen := map[string]bool{c.Admin.Username: c.Admin.Username != ""}
+	for i, u := range c.Admin.Users {
+		field := fmt.Sprintf("admin.users.%d.username", i)
+		if strings.TrimSpace(u.Username) == "" {
+			add(field, "is required")
+		} else if seen[u.Username] {
+			add(field, "duplicate username %q", u.Username)
+		}
+		seen[u.Username] = true
+		required(fmt.Sprintf("admin.users.%d.password", i), u.Password)
+		switch u.Role {
+		case "viewer", "operator", "admin":
+		default:
+			add(fmt.Sprintf("admin.users.%d.role", i), "unknown role %q (expected viewer, operator or admin)", u.Role)
+		}
+	}
+
+	if c.Tracing.Enabled {
+		switch c.Tracing.Exporter {
+		case "otlp":
+			required("tracing.endpoint", c.Tracing.Endpoint)
+		case "stdout":
+		default:
+			add("tracing.exporter", "must be \"otlp\" or \"stdout\", got %q", c.Tracing.Exporter)
+		}
+	}
+	if r := c.Tracing.SampleRatio; r != nil && (*r < 0 || *r > 1) {
+		add("tracing.sampleRatio", "must be between 0 and 1, got %g", *r)
+	}
+
+	for i, dep := range c.Health.RequiredDependencies {
+		switch dep {
+		case "sqlServer", "mqtt", "mongodb":
+		default:
+			add(fmt.Sprintf("health.requiredDependencies.%d", i), "unknown dependency %q (expected sqlServer, mqtt or mongodb)", dep)
+		}
+	}
+	nonNegative("health.maxWatermarkLagSec", c.Health.MaxWatermarkLagSec)
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// brokerClient identifies an MQTT session: a broker drops the older of
+// two connections with the same client ID
+func brokerClient(m MQTTConfig) string {
+	return fmt.Sprintf("%s:%d/%s", m.Broker, m.Port, m.ClientID)
+}
+
+// validateStateTopic checks that a state topic identifies the jaula by
+// its centro and name alone, so it can be cleared without an event
+func validateStateTopic(tmpl string) error {
+	t, err := topic.Parse(tmpl)
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, field := range t.Fields() {
+		switch field {
+		case "prefix", "centro", "jaula":
+			used[field] = true
+		default:
+			return fmt.Errorf("may only use {prefix}, {centro} and {jaula}, not {%s}", field)
+		}
+	}
+	if !used["centro"] || !used["jaula"] {
+		return fmt.Errorf("must include {centro} and {jaula}")
+	}
+	return nil
+}
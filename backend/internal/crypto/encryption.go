@@ -6,7 +6,9 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"strings"
@@ -15,11 +17,21 @@ import (
 const (
 	EncryptedPrefix = "encrypted:"
 	MasterKeyEnv    = "OMNIPOLL_MASTER_KEY"
+
+	// PreviousMasterKeysEnv holds comma-separated retired keys that can
+	// still decrypt existing secrets during a rotation
+	PreviousMasterKeysEnv = "OMNIPOLL_PREVIOUS_MASTER_KEYS"
+
+	// DevMasterKey is used when no master key is configured outside production
+	DevMasterKey = "omnipoll-dev-key-change-in-prod"
 )
 
-// Encryptor handles encryption/decryption of sensitive data
+// Encryptor handles encryption/decryption of sensitive data.
+// Ciphertexts are tagged with the ID of the key that produced them
+// ("encrypted:<keyID>:<base64>") so several keys can coexist.
 type Encryptor struct {
-	key []byte
+	activeID string
+	keys     map[string][]byte
 }
 
 // NewEncryptor creates a new Encryptor using the master key from environment
@@ -27,32 +39,65 @@ func NewEncryptor() (*Encryptor, error) {
 	masterKey := os.Getenv(MasterKeyEnv)
 	if masterKey == "" {
 		// Use a default key for development (NOT for production!)
-		masterKey = "omnipoll-dev-key-change-in-prod"
+		masterKey = DevMasterKey
 	}
 
-	// Derive a 32-byte key using SHA256
-	hash := sha256.Sum256([]byte(masterKey))
-	return &Encryptor{key: hash[:]}, nil
+	var previous []string
+	for _, key := range strings.Split(os.Getenv(PreviousMasterKeysEnv), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			previous = append(previous, key)
+		}
+	}
+
+	return NewEncryptorWithKeys(masterKey, previous...), nil
 }
 
 // NewEncryptorWithKey creates an Encryptor with a specific key
 func NewEncryptorWithKey(masterKey string) *Encryptor {
+	return NewEncryptorWithKeys(masterKey)
+}
+
+// NewEncryptorWithKeys creates an Encryptor that encrypts with active and
+// can still decrypt secrets written with any of the previous keys
+func NewEncryptorWithKeys(active string, previous ...string) *Encryptor {
+	e := &Encryptor{
+		activeID: KeyID(active),
+		keys:     make(map[string][]byte),
+	}
+	e.keys[e.activeID] = deriveKey(active)
+	for _, key := range previous {
+		if id := KeyID(key); id != e.activeID {
+			e.keys[id] = deriveKey(key)
+		}
+	}
+	return e
+}
+
+// KeyID returns the short public identifier of a master key
+func KeyID(masterKey string) string {
+	hash := sha256.Sum256([]byte("omnipoll-key-id:" + masterKey))
+	return hex.EncodeToString(hash[:4])
+}
+
+// deriveKey derives a 32-byte AES key using SHA256
+func deriveKey(masterKey string) []byte {
 	hash := sha256.Sum256([]byte(masterKey))
-	return &Encryptor{key: hash[:]}
+	return hash[:]
 }
 
-// Encrypt encrypts plaintext and returns base64-encoded ciphertext with prefix
+// ActiveKeyID returns the ID of the key used for new ciphertexts
+func (e *Encryptor) ActiveKeyID() string {
+	return e.activeID
+}
+
+// Encrypt encrypts plaintext with the active key and returns the
+// base64-encoded ciphertext with prefix and key ID
 func (e *Encryptor) Encrypt(plaintext string) (string, error) {
 	if plaintext == "" {
 		return "", nil
 	}
 
-	block, err := aes.NewCipher(e.key)
-	if err != nil {
-		return "", err
-	}
-
-	gcm, err := cipher.NewGCM(block)
+	gcm, err := newGCM(e.keys[e.activeID])
 	if err != nil {
 		return "", err
 	}
@@ -65,7 +110,7 @@ func (e *Encryptor) Encrypt(plaintext string) (string, error) {
 	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
 	encoded := base64.StdEncoding.EncodeToString(ciphertext)
 
-	return EncryptedPrefix + encoded, nil
+	return EncryptedPrefix + e.activeID + ":" + encoded, nil
 }
 
 // Decrypt decrypts a prefixed encrypted string
@@ -79,18 +124,66 @@ func (e *Encryptor) Decrypt(encrypted string) (string, error) {
 		return encrypted, nil
 	}
 
-	encoded := strings.TrimPrefix(encrypted, EncryptedPrefix)
+	keyID, encoded := splitKeyID(encrypted)
 	ciphertext, err := base64.StdEncoding.DecodeString(encoded)
 	if err != nil {
 		return "", err
 	}
 
-	block, err := aes.NewCipher(e.key)
+	if keyID != "" {
+		key, ok := e.keys[keyID]
+		if !ok {
+			return "", fmt.Errorf("secret was encrypted with unknown key %s (set %s or %s)", keyID, MasterKeyEnv, PreviousMasterKeysEnv)
+		}
+		return open(key, ciphertext)
+	}
+
+	// Legacy ciphertext without key ID: try the active key first, then the rest
+	if plaintext, err := open(e.keys[e.activeID], ciphertext); err == nil {
+		return plaintext, nil
+	}
+	for id, key := range e.keys {
+		if id == e.activeID {
+			continue
+		}
+		if plaintext, err := open(key, ciphertext); err == nil {
+			return plaintext, nil
+		}
+	}
+	return "", errors.New("failed to decrypt secret with any configured key")
+}
+
+// NeedsRotation reports whether an encrypted value was not written with
+// the active key (including legacy values without a key ID)
+func (e *Encryptor) NeedsRotation(encrypted string) bool {
+	if !IsEncrypted(encrypted) {
+		return false
+	}
+	keyID, _ := splitKeyID(encrypted)
+	return keyID != e.activeID
+}
+
+// splitKeyID separates "encrypted:<keyID>:<base64>" into its parts.
+// Legacy values ("encrypted:<base64>") return an empty key ID.
+func splitKeyID(encrypted string) (string, string) {
+	rest := strings.TrimPrefix(encrypted, EncryptedPrefix)
+	// Base64 never contains ':', so a colon means a key ID is present
+	if keyID, encoded, ok := strings.Cut(rest, ":"); ok {
+		return keyID, encoded
+	}
+	return "", rest
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	return cipher.NewGCM(block)
+}
 
-	gcm, err := cipher.NewGCM(block)
+func open(key, ciphertext []byte) (string, error) {
+	gcm, err := newGCM(key)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,55 @@
+package crypto
+
+import (
+	"crypto/subtle"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHashCost is the bcrypt cost used for admin passwords
+const PasswordHashCost = 12
+
+// dummyHash is compared against when a username is unknown so that
+// failed lookups take as long as a wrong password
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// HashPassword returns a bcrypt hash of password
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), PasswordHashCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// IsPasswordHash checks if a string is a bcrypt hash
+func IsPasswordHash(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
+}
+
+// CheckPassword compares password with a stored value. Hashes are checked
+// with bcrypt; legacy plain-text values with a constant-time comparison.
+// An empty stored value never matches.
+func CheckPassword(stored, password string) bool {
+	if stored == "" {
+		return false
+	}
+	if IsPasswordHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+// BurnPasswordCheck performs a throwaway bcrypt comparison so unknown
+// usernames cost the same time as known ones
+func BurnPasswordCheck(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("omnipoll-dummy-password"), PasswordHashCost)
+	})
+	_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
@@ -0,0 +1,144 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AuditEntry records a single administrative action
+type AuditEntry struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Timestamp time.Time          `bson:"timestamp" json:"timestamp"`
+	Actor     string             `bson:"actor" json:"actor"`
+	Action    string             `bson:"action" json:"action"` // e.g. "config.update", "event.delete"
+	Target    string             `bson:"target" json:"target"`
+	SourceIP  string             `bson:"sourceIp" json:"sourceIp"`
+	Changes   []FieldChange      `bson:"changes,omitempty" json:"changes,omitempty"`
+	Details   map[string]string  `bson:"details,omitempty" json:"details,omitempty"`
+}
+
+// FieldChange is one changed field in an audit entry's before/after diff
+type FieldChange struct {
+	Field  string      `bson:"field" json:"field"`
+	Before interface{} `bson:"before" json:"before"`
+	After  interface{} `bson:"after" json:"after"`
+}
+
+// AuditQueryOptions defines filtering and pagination for the audit log
+type AuditQueryOptions struct {
+	Page      int
+	PageSize  int
+	Actor     string
+	Action    string
+	Target    string
+	StartDate *time.Time
+	EndDate   *time.Time
+}
+
+// AuditQueryResult represents a page of audit entries
+type AuditQueryResult struct {
+	Data       []AuditEntry `json:"data"`
+	Total      int64        `json:"total"`
+	Page       int          `json:"page"`
+	PageSize   int          `json:"pageSize"`
+	TotalPages int          `json:"totalPages"`
+}
+
+// AuditRepository handles persistence of the audit trail
+type AuditRepository struct {
+	client *Client
+}
+
+// NewAuditRepository creates a new audit repository
+func NewAuditRepository(client *Client) *AuditRepository {
+	return &AuditRepository{
+		client: client,
+	}
+}
+
+// Insert stores an audit entry
+func (r *AuditRepository) Insert(ctx context.Context, entry AuditEntry) error {
+	coll := r.client.GetAuditCollection()
+	if coll == nil {
+		return fmt.Errorf("mongodb not connected")
+	}
+
+	if _, err := coll.InsertOne(ctx, entry); err != nil {
+		return fmt.Errorf("failed to insert audit entry: %w", err)
+	}
+	return nil
+}
+
+// Query returns audit entries, newest first
+func (r *AuditRepository) Query(ctx context.Context, opts AuditQueryOptions) (*AuditQueryResult, error) {
+	coll := r.client.GetAuditCollection()
+	if coll == nil {
+		return nil, fmt.Errorf("mongodb not connected")
+	}
+
+	filter := bson.M{}
+	if opts.Actor != "" {
+		filter["actor"] = opts.Actor
+	}
+	if opts.Action != "" {
+		filter["action"] = opts.Action
+	}
+	if opts.Target != "" {
+		filter["target"] = bson.M{"$regex": primitive.Regex{Pattern: regexp.QuoteMeta(opts.Target), Options: "i"}}
+	}
+	if opts.StartDate != nil || opts.EndDate != nil {
+		dateFilter := bson.M{}
+		if opts.StartDate != nil {
+			dateFilter["$gte"] = opts.StartDate
+		}
+		if opts.EndDate != nil {
+			dateFilter["$lte"] = opts.EndDate
+		}
+		filter["timestamp"] = dateFilter
+	}
+
+	total, err := coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count audit entries: %w", err)
+	}
+
+	if opts.Page < 1 {
+		opts.Page = 1
+	}
+	if opts.PageSize < 1 {
+		opts.PageSize = 50
+	}
+	if opts.PageSize > 500 {
+		opts.PageSize = 500
+	}
+
+	findOpts := options.Find().
+		SetSkip(int64((opts.Page - 1) * opts.PageSize)).
+		SetLimit(int64(opts.PageSize)).
+		SetSort(bson.D{{Key: "timestamp", Value: -1}})
+
+	cursor, err := coll.Find(ctx, filter, findOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit entries: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	entries := []AuditEntry{}
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, fmt.Errorf("failed to decode audit entries: %w", err)
+	}
+
+	return &AuditQueryResult{
+		Data:       entries,
+		Total:      total,
+		Page:       opts.Page,
+		PageSize:   opts.PageSize,
+		TotalPages: (int(total) + opts.PageSize - 1) / opts.PageSize,
+	}, nil
+}
@@ -57,8 +57,26 @@ func (c *Client) Connect(ctx context.Context) error {
 	return nil
 }
 
+// AuditCollectionName is the collection holding the admin audit trail
+const AuditCollectionName = "audit_log"
+
 // createIndexes creates the recommended indexes
 func (c *Client) createIndexes(ctx context.Context) error {
+	auditIndexes := []mongo.IndexModel{
+		{
+			Keys: map[string]int{"timestamp": -1},
+		},
+		{
+			Keys: map[string]int{"actor": 1},
+		},
+		{
+			Keys: map[string]int{"action": 1},
+		},
+	}
+	if _, err := c.database.Collection(AuditCollectionName).Indexes().CreateMany(ctx, auditIndexes); err != nil {
+		return err
+	}
+
 	indexes := []mongo.IndexModel{
 		{
 			Keys: map[string]int{"fechaHora": 1},
@@ -101,6 +119,14 @@ func (c *Client) GetCollection() *mongo.Collection {
 	return c.collection
 }
 
+// GetAuditCollection returns the audit log collection
+func (c *Client) GetAuditCollection() *mongo.Collection {
+	if c.database == nil {
+		return nil
+	}
+	return c.database.Collection(AuditCollectionName)
+}
+
 // TestConnection tests the MongoDB connection
 func (c *Client) TestConnection(ctx context.Context) error {
 	if c.client == nil {
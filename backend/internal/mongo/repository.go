@@ -3,6 +3,7 @@ package mongo
 import (
 	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -89,6 +90,50 @@ func (r *Repository) eventToDocument(event events.NormalizedEvent) HistoricalEve
 	}
 }
 
+// documentToEvent rebuilds the event stored by eventToDocument
+func documentToEvent(doc HistoricalEvent) events.NormalizedEvent {
+	str := func(key string) string {
+		v, _ := doc.Payload[key].(string)
+		return v
+	}
+	num := func(key string) float64 {
+		switch v := doc.Payload[key].(type) {
+		case float64:
+			return v
+		case int32:
+			return float64(v)
+		case int64:
+			return float64(v)
+		}
+		return 0
+	}
+
+	return events.NormalizedEvent{
+		ID:            strings.TrimPrefix(doc.ID, doc.Source+":"),
+		Source:        doc.Source,
+		Name:          str("name"),
+		UnitName:      doc.UnitName,
+		FechaHora:     doc.FechaHora.UTC().Format(time.RFC3339),
+		Dia:           str("dia"),
+		Inicio:        str("inicio"),
+		Fin:           str("fin"),
+		Dif:           int(num("dif")),
+		AmountGrams:   num("amountGrams"),
+		PelletFishMin: num("pelletFishMin"),
+		FishCount:     num("fishCount"),
+		PesoProm:      num("pesoProm"),
+		Biomasa:       num("biomasa"),
+		PelletPK:      num("pelletPK"),
+		FeedName:      str("feedName"),
+		SiloName:      str("siloName"),
+		DoserName:     str("doserName"),
+		GramsPerSec:   num("gramsPerSec"),
+		KgTonMin:      num("kgTonMin"),
+		Marca:         int(num("marca")),
+		IngestedAt:    doc.IngestedAt,
+	}
+}
+
 // CountEvents returns the total number of events
 func (r *Repository) CountEvents(ctx context.Context) (int64, error) {
 	return r.client.GetCollection().CountDocuments(ctx, bson.M{})
@@ -108,6 +153,54 @@ func (r *Repository) CountEventsToday(ctx context.Context) (int64, error) {
 	return r.client.GetCollection().CountDocuments(ctx, filter)
 }
 
+// JaulaDay identifies the feedings of one jaula on one day
+type JaulaDay struct {
+	Centro   string // payload.name
+	UnitName string
+	Dia      string
+}
+
+// DayTotals sums amountGrams of the stored events of each jaula and day
+func (r *Repository) DayTotals(ctx context.Context, keys []JaulaDay) (map[JaulaDay]float64, error) {
+	totals := make(map[JaulaDay]float64, len(keys))
+	if len(keys) == 0 {
+		return totals, nil
+	}
+
+	match := make(bson.A, len(keys))
+	for i, k := range keys {
+		match[i] = bson.M{"payload.name": k.Centro, "unitName": k.UnitName, "payload.dia": k.Dia}
+	}
+	pipeline := bson.A{
+		bson.M{"$match": bson.M{"$or": match}},
+		bson.M{"$group": bson.M{
+			"_id":   bson.M{"centro": "$payload.name", "unitName": "$unitName", "dia": "$payload.dia"},
+			"grams": bson.M{"$sum": "$payload.amountGrams"},
+		}},
+	}
+	cursor, err := r.client.GetCollection().Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sum day totals: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var row struct {
+			ID struct {
+				Centro   string `bson:"centro"`
+				UnitName string `bson:"unitName"`
+				Dia      string `bson:"dia"`
+			} `bson:"_id"`
+			Grams float64 `bson:"grams"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			return nil, err
+		}
+		totals[JaulaDay{Centro: row.ID.Centro, UnitName: row.ID.UnitName, Dia: row.ID.Dia}] = row.Grams
+	}
+	return totals, cursor.Err()
+}
+
 // IsConnected returns connection status
 func (r *Repository) IsConnected() bool {
 	return r.client.IsConnected()
@@ -175,6 +268,32 @@ func (r *Repository) GetByID(ctx context.Context, id string) (*HistoricalEvent,
 	return &event, nil
 }
 
+// EventsInRange returns up to limit stored events with fechaHora in
+// [from, to], oldest first
+func (r *Repository) EventsInRange(ctx context.Context, from, to time.Time, limit int) ([]events.NormalizedEvent, error) {
+	filter := bson.M{"fechaHora": bson.M{"$gte": from, "$lte": to}}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "fechaHora", Value: 1}, {Key: "_id", Value: 1}}).
+		SetLimit(int64(limit))
+
+	cursor, err := r.client.GetCollection().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query events: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var docs []HistoricalEvent
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, fmt.Errorf("failed to decode events: %w", err)
+	}
+
+	evts := make([]events.NormalizedEvent, len(docs))
+	for i, doc := range docs {
+		evts[i] = documentToEvent(doc)
+	}
+	return evts, nil
+}
+
 // QueryOptions defines filtering and pagination options
 type QueryOptions struct {
 	Page      int                  `json:"page"`      // 1-based page number
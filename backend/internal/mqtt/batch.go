@@ -0,0 +1,298 @@
+package mqtt
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+
+	"github.com/omnipoll/backend/internal/events"
+)
+
+// defaultBatchMaxBytes caps a batch message when mqtt.batchMaxBytes is unset
+const defaultBatchMaxBytes = 256 * 1024
+
+// encoded is one event rendered by one payload profile, before framing
+// and compression
+type encoded struct {
+	event int // Index in the batch
+	data  []byte
+}
+
+// lane holds the messages for one profile and topic, published in order
+type lane struct {
+	out    *output
+	output int // Index of out in p.outputs
+	topic  string
+	items  []encoded
+}
+
+// outgoing is a message, the batch indexes of the events it carries and
+// the output (payload profile) it renders them with
+type outgoing struct {
+	msg    Message
+	events []int
+	output int
+}
+
+// profileSet marks payload profiles by their index in p.outputs. A nil
+// set stands for every profile.
+type profileSet []bool
+
+// has reports whether the set includes output o
+func (s profileSet) has(o int) bool {
+	return s == nil || (o < len(s) && s[o])
+}
+
+// PublishBatch publishes multiple events to MQTT. Messages for the same
+// topic go out in event order; with mqtt.maxInFlight > 1 different
+// topics are published concurrently, and with mqtt.batchMaxEvents > 1
+// events for the same topic are packed into array messages.
+func (p *Publisher) PublishBatch(evts []events.NormalizedEvent) error {
+	_, err := p.publishBatch(evts, nil)
+	return err
+}
+
+// publishBatch is PublishBatch for the profiles in todo[i] of each event
+// (all when todo or todo[i] is nil). It reports the profiles each event
+// failed with, nil for events that were published.
+func (p *Publisher) publishBatch(evts []events.NormalizedEvent, todo []profileSet) ([]profileSet, error) {
+	total := len(evts)
+	cfg := p.client.GetConfig()
+
+	log.Printf("[MQTT] Publishing %d events to %s:%d (QoS: %d, batch: %d, in-flight: %d)",
+		total, cfg.Broker, cfg.Port, cfg.QoS, cfg.BatchMaxEvents, cfg.MaxInFlight)
+
+	failed := make([]profileSet, total)
+	if !p.client.IsConnected() {
+		for i := range failed {
+			failed[i] = p.allOf(profileSetOf(todo, i))
+		}
+		return failed, fmt.Errorf("published 0/%d events: MQTT client not connected", total)
+	}
+	if p.sparkplug != nil {
+		return p.sparkplug.publishBatch(evts)
+	}
+
+	var mu sync.Mutex
+	errorCount := 0
+	sent := 0
+	fail := func(eventIdx []int, output int, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errorCount++
+		// Log first error only
+		if errorCount == 1 {
+			log.Printf("[MQTT] First error - Event: %s, Error: %v", evts[eventIdx[0]].ID, err)
+		}
+		for _, i := range eventIdx {
+			if failed[i] == nil {
+				failed[i] = make(profileSet, len(p.outputs))
+			}
+			failed[i][output] = true
+		}
+	}
+
+	// An event whose topic or payload cannot be rendered would fail
+	// every retry and hold up the outbox, so it is skipped
+	skipped := 0
+	skip := func(i, output int, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		skipped++
+		log.Printf("[MQTT] Skipping event %s for payload profile %s: %v", evts[i].ID, p.outputs[output].profile, err)
+	}
+
+	lanes := p.lanes(evts, todo, skip)
+	window := cfg.MaxInFlight
+	if window < 1 {
+		window = 1
+	}
+
+	publish := func(out outgoing) {
+		err := p.client.Publish(out.msg)
+		if err != nil {
+			fail(out.events, out.output, err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		before := sent
+		sent += len(out.events)
+		// Log progress every 25 events
+		if sent/25 > before/25 {
+			log.Printf("[MQTT] Progress: %d events sent (%d errors)", sent, errorCount)
+		}
+	}
+
+	if window == 1 {
+		// Sequential, in event order across topics
+		for _, out := range p.interleave(evts, lanes) {
+			publish(out)
+		}
+	} else {
+		sem := make(chan struct{}, window)
+		var wg sync.WaitGroup
+		for _, l := range lanes {
+			wg.Add(1)
+			go func(msgs []outgoing) {
+				defer wg.Done()
+				for _, out := range msgs {
+					sem <- struct{}{}
+					publish(out)
+					<-sem
+				}
+			}(p.messages(evts, l))
+		}
+		wg.Wait()
+	}
+
+	successCount := 0
+	for _, f := range failed {
+		if f == nil {
+			successCount++
+		}
+	}
+	log.Printf("[MQTT] Complete: %d/%d published successfully (%d skipped)", successCount, total, skipped)
+
+	if successCount < total {
+		return failed, fmt.Errorf("published %d/%d events (%d errors)", successCount, total, errorCount)
+	}
+	return failed, nil
+}
+
+// lanes encodes every event with its payload profiles in todo and
+// groups the results by profile and topic, keeping event order within
+// each group. Events that cannot be rendered are passed to skip.
+func (p *Publisher) lanes(evts []events.NormalizedEvent, todo []profileSet, skip func(int, int, error)) []*lane {
+	var lanes []*lane
+	index := make(map[string]*lane)
+	for i, event := range evts {
+		for o := range p.outputs {
+			if !profileSetOf(todo, i).has(o) {
+				continue
+			}
+			out := &p.outputs[o]
+			topic, err := out.topics.Topic(event)
+			if err != nil {
+				skip(i, o, err)
+				continue
+			}
+			data, err := out.codec.Marshal(out.record(event))
+			if err != nil {
+				skip(i, o, err)
+				continue
+			}
+
+			key := out.profile + "\x00" + topic
+			l, ok := index[key]
+			if !ok {
+				l = &lane{out: out, output: o, topic: topic}
+				index[key] = l
+				lanes = append(lanes, l)
+			}
+			l.items = append(l.items, encoded{event: i, data: data})
+		}
+	}
+	return lanes
+}
+
+// messages turns a lane into messages: one per event, or arrays bounded
+// by mqtt.batchMaxEvents and mqtt.batchMaxBytes (measured before
+// compression)
+func (p *Publisher) messages(evts []events.NormalizedEvent, l *lane) []outgoing {
+	cfg := p.client.GetConfig()
+	batch := cfg.BatchMaxEvents > 1
+	newMessage := func(items [][]byte, idx []int) outgoing {
+		props := p.eventProperties(evts[idx[0]], *l.out, batch)
+		if batch {
+			props.CorrelationData = nil
+			props.User = append(props.User, UserProperty{Key: "batchSize", Value: strconv.Itoa(len(idx))})
+		}
+		return outgoing{
+			msg:    Message{Topic: l.topic, QoS: cfg.QoS, Payload: l.out.codec.Message(items, batch), Properties: props},
+			events: idx,
+			output: l.output,
+		}
+	}
+
+	var msgs []outgoing
+	if !batch {
+		for _, item := range l.items {
+			msgs = append(msgs, newMessage([][]byte{item.data}, []int{item.event}))
+		}
+		return msgs
+	}
+
+	maxBytes := cfg.BatchMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultBatchMaxBytes
+	}
+	var items [][]byte
+	var idx []int
+	size := 0
+	flush := func() {
+		if len(idx) == 0 {
+			return
+		}
+		msgs = append(msgs, newMessage(items, idx))
+		items, idx, size = nil, nil, 0
+	}
+	for _, item := range l.items {
+		// An event larger than maxBytes still goes out, alone. The +2
+		// allows for array framing, e.g. the JSON separator
+		if len(idx) == cfg.BatchMaxEvents || (len(idx) > 0 && size+len(item.data)+2 > maxBytes) {
+			flush()
+		}
+		items = append(items, item.data)
+		idx = append(idx, item.event)
+		size += len(item.data) + 1
+	}
+	flush()
+	return msgs
+}
+
+// profileSetOf returns the profiles of event i in todo, nil for all
+func profileSetOf(todo []profileSet, i int) profileSet {
+	if todo == nil {
+		return nil
+	}
+	return todo[i]
+}
+
+// allOf returns s with nil spelled out as every profile of the
+// publisher (a single one in sparkplug mode)
+func (p *Publisher) allOf(s profileSet) profileSet {
+	if s != nil {
+		return s
+	}
+	all := make(profileSet, max(len(p.outputs), 1))
+	for o := range all {
+		all[o] = true
+	}
+	return all
+}
+
+// interleave returns the messages of all lanes ordered by their first
+// event, which is the original event order when batching is off
+func (p *Publisher) interleave(evts []events.NormalizedEvent, lanes []*lane) []outgoing {
+	queues := make([][]outgoing, len(lanes))
+	n := 0
+	for i, l := range lanes {
+		queues[i] = p.messages(evts, l)
+		n += len(queues[i])
+	}
+
+	ordered := make([]outgoing, 0, n)
+	for len(ordered) < n {
+		next := -1
+		for i, q := range queues {
+			if len(q) > 0 && (next < 0 || q[0].events[0] < queues[next][0].events[0]) {
+				next = i
+			}
+		}
+		ordered = append(ordered, queues[next][0])
+		queues[next] = queues[next][1:]
+	}
+	return ordered
+}
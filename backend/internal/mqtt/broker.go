@@ -0,0 +1,385 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/omnipoll/backend/internal/events"
+)
+
+const (
+	// defaultOutboxMaxEvents applies when mqtt.outboxMaxEvents is unset
+	defaultOutboxMaxEvents = 10000
+	// outboxChunk is the most events handed to one PublishBatch
+	outboxChunk = 500
+	// outboxRetryDelay is the wait before retrying a failed publish
+	outboxRetryDelay = 5 * time.Second
+)
+
+// Broker is one MQTT output: a connection, its publisher, and an outbox
+// of events waiting to be published. Each broker publishes from its own
+// goroutine, so a slow or unreachable broker does not hold up the
+// others. The outbox is kept in memory only; the poller stops fetching
+// while it is full (see Brokers.Room).
+type Broker struct {
+	name   string
+	client *Client
+	pub    *Publisher
+
+	mu          sync.Mutex
+	queue       []outboxItem
+	maxQueue    int
+	sending     int // Events taken from the queue and being published
+	published   int64
+	dropped     int64
+	lastError   string
+	lastPublish time.Time
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// outboxItem is a queued event and the payload profiles it still has to
+// be published with, nil for all of them
+type outboxItem struct {
+	event    events.NormalizedEvent
+	profiles profileSet
+}
+
+// BrokerStatus describes a broker output for the status API
+type BrokerStatus struct {
+	Name        string `json:"name"`
+	Broker      string `json:"broker"` // host:port
+	Connected   bool   `json:"connected"`
+	Queued      int    `json:"queued"`    // Events in the outbox
+	Published   int64  `json:"published"` // Events published since start
+	Dropped     int64  `json:"dropped"`   // Events lost to a full outbox
+	LastError   string `json:"lastError,omitempty"`
+	LastPublish string `json:"lastPublish,omitempty"` // RFC3339
+
+	Throttled        bool    `json:"throttled"`        // Publishes are waiting for the rate limit
+	ThrottledSeconds float64 `json:"throttledSeconds"` // Time spent waiting for the rate limit since start
+	InFlight         int     `json:"inFlight"`         // Unacknowledged QoS 1/2 messages
+	MaxInFlight      int     `json:"maxInFlight"`
+}
+
+// NewBroker creates the output publishing through client and starts its
+// sender. Call it before client.Connect, since the publisher may
+// subscribe.
+func NewBroker(name string, client *Client) *Broker {
+	maxQueue := client.GetConfig().OutboxMaxEvents
+	if maxQueue <= 0 {
+		maxQueue = defaultOutboxMaxEvents
+	}
+	b := &Broker{
+		name:     name,
+		client:   client,
+		pub:      NewPublisher(client),
+		maxQueue: maxQueue,
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// Name returns the output name, "primary" for the mqtt section
+func (b *Broker) Name() string {
+	return b.name
+}
+
+// Enqueue adds events to the outbox and returns how many old events
+// were dropped to make room. Callers check Room first, so this only
+// happens when they race.
+func (b *Broker) Enqueue(evts []events.NormalizedEvent) int {
+	b.mu.Lock()
+	for _, event := range evts {
+		b.queue = append(b.queue, outboxItem{event: event})
+	}
+	dropped := b.trim()
+	b.mu.Unlock()
+
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	return dropped
+}
+
+// trim drops the oldest events beyond the outbox size. Called with b.mu
+// held.
+func (b *Broker) trim() int {
+	excess := len(b.queue) - b.maxQueue
+	if excess <= 0 {
+		return 0
+	}
+	b.queue = append([]outboxItem(nil), b.queue[excess:]...)
+	b.dropped += int64(excess)
+	log.Printf("[MQTT %s] WARNING: outbox full, dropped the %d oldest events", b.name, excess)
+	return excess
+}
+
+// run publishes the outbox whenever events arrive, retrying after a
+// delay while the broker fails
+func (b *Broker) run() {
+	defer close(b.done)
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-b.wake:
+		}
+		for !b.drain() {
+			select {
+			case <-b.stop:
+				return
+			case <-time.After(outboxRetryDelay):
+			}
+		}
+	}
+}
+
+// drain publishes the outbox in chunks, oldest first, until it is empty
+// or the broker is closing. Failed events go back to the head of the
+// outbox, in order, with only the payload profiles that failed, and
+// drain returns false.
+func (b *Broker) drain() bool {
+	for {
+		select {
+		case <-b.stop:
+			return true
+		default:
+		}
+		b.mu.Lock()
+		n := len(b.queue)
+		if n > outboxChunk {
+			n = outboxChunk
+		}
+		chunk := b.queue[:n:n]
+		b.queue = b.queue[n:]
+		b.sending = n
+		b.mu.Unlock()
+		if n == 0 {
+			return true
+		}
+
+		evts := make([]events.NormalizedEvent, n)
+		todo := make([]profileSet, n)
+		for i, item := range chunk {
+			evts[i], todo[i] = item.event, item.profiles
+		}
+		var failed []profileSet
+		var err error
+		if b.client.IsConnectionOpen() {
+			failed, err = b.pub.publishBatch(evts, todo)
+		} else {
+			failed = make([]profileSet, n)
+			for i := range failed {
+				failed[i] = b.pub.allOf(todo[i])
+			}
+			err = fmt.Errorf("MQTT client not connected")
+		}
+
+		var retry []outboxItem
+		for i, f := range failed {
+			if f != nil {
+				retry = append(retry, outboxItem{event: evts[i], profiles: f})
+			}
+		}
+		b.mu.Lock()
+		b.sending = 0
+		b.published += int64(n - len(retry))
+		if len(retry) < n {
+			b.lastPublish = time.Now().UTC()
+		}
+		if err != nil {
+			b.lastError = err.Error()
+			b.queue = append(retry, b.queue...)
+			b.trim()
+		} else {
+			b.lastError = ""
+		}
+		b.mu.Unlock()
+		if err != nil {
+			return false
+		}
+	}
+}
+
+// pending returns the events not yet published
+func (b *Broker) pending() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.queue) + b.sending
+}
+
+// room returns how many more events the outbox holds
+func (b *Broker) room() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.maxQueue - len(b.queue) - b.sending
+}
+
+// Status reports the broker connection and outbox
+func (b *Broker) Status() BrokerStatus {
+	cfg := b.client.GetConfig()
+	flow := b.client.FlowStatus()
+	status := BrokerStatus{
+		Name:             b.name,
+		Broker:           fmt.Sprintf("%s:%d", cfg.Broker, cfg.Port),
+		Connected:        b.client.IsConnectionOpen(),
+		Throttled:        flow.Throttled,
+		ThrottledSeconds: flow.ThrottledSeconds,
+		InFlight:         flow.InFlight,
+		MaxInFlight:      flow.MaxInFlight,
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status.Queued = len(b.queue) + b.sending
+	status.Published = b.published
+	status.Dropped = b.dropped
+	status.LastError = b.lastError
+	if !b.lastPublish.IsZero() {
+		status.LastPublish = b.lastPublish.Format(time.RFC3339)
+	}
+	return status
+}
+
+// Close gives the outbox until ctx is done to empty, then lifts the rate
+// limits so the sender can finish its chunk, stops it and disconnects.
+// Events still queued are lost.
+func (b *Broker) Close(ctx context.Context) {
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+wait:
+	for b.pending() > 0 && b.client.IsConnectionOpen() {
+		select {
+		case <-ctx.Done():
+			break wait
+		case <-tick.C:
+		}
+	}
+	if n := b.pending(); n > 0 {
+		log.Printf("[MQTT %s] WARNING: closing with %d unpublished events", b.name, n)
+	}
+	b.client.flow.lift()
+	close(b.stop)
+	<-b.done
+	b.pub.Close()
+	b.client.Disconnect()
+}
+
+// Brokers publishes every event to each MQTT output. The first is the
+// primary broker of the mqtt section.
+type Brokers struct {
+	list []*Broker
+}
+
+// NewBrokers groups the outputs, primary first
+func NewBrokers(list []*Broker) *Brokers {
+	return &Brokers{list: list}
+}
+
+// Enqueue hands the events to every broker's outbox. The error reports
+// events dropped from full outboxes.
+func (bs *Brokers) Enqueue(evts []events.NormalizedEvent) error {
+	var errs []error
+	for _, b := range bs.list {
+		if dropped := b.Enqueue(evts); dropped > 0 {
+			errs = append(errs, fmt.Errorf("%s: outbox full, dropped %d events", b.name, dropped))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Room returns how many events every outbox can still take. The poller
+// fetches no more than this, so a broker that falls behind holds back
+// the watermark instead of losing events.
+func (bs *Brokers) Room() int {
+	room := math.MaxInt
+	for _, b := range bs.list {
+		room = min(room, b.room())
+	}
+	return max(room, 0)
+}
+
+// StateEnabled reports whether any broker has mqtt.stateTopic set
+func (bs *Brokers) StateEnabled() bool {
+	for _, b := range bs.list {
+		if b.pub.StateEnabled() {
+			return true
+		}
+	}
+	return false
+}
+
+// PublishStates publishes the retained jaula states to every connected
+// broker with a state topic. States are not queued: the next batch
+// brings them up to date.
+func (bs *Brokers) PublishStates(states []JaulaState) error {
+	var errs []error
+	for _, b := range bs.list {
+		if !b.pub.StateEnabled() || !b.client.IsConnectionOpen() {
+			continue
+		}
+		if err := b.pub.PublishStates(states); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", b.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ClearState removes the retained state of a jaula from every broker
+// with a state topic
+func (bs *Brokers) ClearState(centro, jaula string) error {
+	var errs []error
+	cleared := false
+	for _, b := range bs.list {
+		if !b.pub.StateEnabled() {
+			continue
+		}
+		if err := b.pub.ClearState(centro, jaula); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", b.name, err))
+			continue
+		}
+		cleared = true
+	}
+	if !cleared && len(errs) == 0 {
+		return fmt.Errorf("mqtt.stateTopic is not set")
+	}
+	return errors.Join(errs...)
+}
+
+// IsConnected reports whether the primary broker is connected
+func (bs *Brokers) IsConnected() bool {
+	return len(bs.list) > 0 && bs.list[0].client.IsConnected()
+}
+
+// Status reports every broker, primary first
+func (bs *Brokers) Status() []BrokerStatus {
+	statuses := make([]BrokerStatus, len(bs.list))
+	for i, b := range bs.list {
+		statuses[i] = b.Status()
+	}
+	return statuses
+}
+
+// Close flushes and disconnects every broker, in parallel
+func (bs *Brokers) Close(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, b := range bs.list {
+		wg.Add(1)
+		go func(b *Broker) {
+			defer wg.Done()
+			b.Close(ctx)
+		}(b)
+	}
+	wg.Wait()
+}
@@ -1,12 +1,14 @@
 package mqtt
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"sync"
 	"time"
 
+	"github.com/eclipse/paho.golang/autopaho"
 	paho "github.com/eclipse/paho.mqtt.golang"
 	"github.com/omnipoll/backend/internal/config"
 )
@@ -14,10 +16,51 @@ import (
 // Client manages MQTT broker connection
 type Client struct {
 	mu       sync.RWMutex
-	client   paho.Client
+	client   paho.Client                  // MQTT 3.1.1
+	v5       *autopaho.ConnectionManager  // MQTT 5
+	cancelV5 context.CancelFunc
+	aliases  topicAliases
 	config   config.MQTTConfig
 	connected bool
 	stopHeartbeat chan struct{}
+	hbMu     sync.Mutex // Guards stopHeartbeat
+
+	// statusSource, when set, enables the status topic: a retained
+	// "online" heartbeat carrying its report, and an "offline" Last Will
+	statusSource func() interface{}
+
+	subs []*subscription // Renewed on every connection
+
+	// session counts broker connections, so state tied to one connection
+	// (e.g. Sparkplug births) can tell when it is stale
+	session uint64
+
+	flow *flowControl // Rate limits and the QoS 1/2 in-flight window
+}
+
+// Message is an outgoing publish. Properties are only sent over MQTT 5
+// and ignored by 3.1.1 connections.
+type Message struct {
+	Topic      string
+	QoS        byte
+	Retained   bool
+	Payload    []byte
+	Properties *Properties
+}
+
+// Properties are the MQTT 5 publish properties set by omnipoll
+type Properties struct {
+	ContentType     string
+	MessageExpiry   uint32 // Seconds, 0 = never expires
+	ResponseTopic   string
+	CorrelationData []byte
+	User            []UserProperty
+}
+
+// UserProperty is an MQTT 5 user property; keys may repeat
+type UserProperty struct {
+	Key   string
+	Value string
 }
 
 // NewClient creates a new MQTT client
@@ -25,12 +68,34 @@ func NewClient(cfg config.MQTTConfig) *Client {
 	return &Client{
 		config: cfg,
 		stopHeartbeat: make(chan struct{}),
+		flow:   newFlowControl(fmt.Sprintf("%s:%d", cfg.Broker, cfg.Port), cfg),
 	}
 }
 
+// EnableStatus turns on the status topic, with source reporting the
+// worker state in each heartbeat. Call it before Connect.
+func (c *Client) EnableStatus(source func() interface{}) {
+	c.statusSource = source
+}
+
 // restartHeartbeat stops any existing heartbeat and starts a new one
 func (c *Client) restartHeartbeat() {
+	if c.statusSource == nil {
+		return
+	}
+	c.hbMu.Lock()
+	defer c.hbMu.Unlock()
+
 	// Stop previous heartbeat if running
+	c.closeHeartbeat()
+	// Create new channel and start goroutine
+	c.stopHeartbeat = make(chan struct{})
+	go c.startHeartbeat(c.stopHeartbeat)
+	log.Printf("[MQTT Client] Heartbeat started")
+}
+
+// closeHeartbeat stops the heartbeat goroutine. Called with c.hbMu held.
+func (c *Client) closeHeartbeat() {
 	if c.stopHeartbeat != nil {
 		select {
 		case <-c.stopHeartbeat:
@@ -39,10 +104,6 @@ func (c *Client) restartHeartbeat() {
 			close(c.stopHeartbeat)
 		}
 	}
-	// Create new channel and start goroutine
-	c.stopHeartbeat = make(chan struct{})
-	go c.startHeartbeat()
-	log.Printf("[MQTT Client] Heartbeat started")
 }
 
 // Connect establishes connection to MQTT broker
@@ -50,14 +111,25 @@ func (c *Client) Connect() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// Determine protocol: use TLS for port 8883 or if UseTLS is explicitly set
-	protocol := "tcp"
-	if c.config.UseTLS || c.config.Port == 8883 {
-		protocol = "ssl"
-	}
-	broker := fmt.Sprintf("%s://%s:%d", protocol, c.config.Broker, c.config.Port)
+	broker := brokerURL(c.config)
+	secure := usesTLS(c.config)
 
-	fmt.Printf("[MQTT Client] Connecting to broker: %s (User: %s, TLS: %v)\n", broker, c.config.User, c.config.UseTLS)
+	fmt.Printf("[MQTT Client] Connecting to broker: %s (User: %s, TLS: %v, MQTT %s)\n", broker, c.config.User, secure, c.protocolName())
+
+	var tlsCfg *tls.Config
+	if secure {
+		var err error
+		tlsCfg, err = buildTLSConfig(c.config)
+		if err != nil {
+			return err
+		}
+		if tlsCfg.InsecureSkipVerify {
+			log.Printf("[MQTT Client] WARNING: TLS certificate verification is disabled")
+		}
+	}
+	if c.isV5() {
+		return c.connectV5(broker, tlsCfg)
+	}
 
 	opts := paho.NewClientOptions().
 		AddBroker(broker).
@@ -77,18 +149,27 @@ func (c *Client) Connect() error {
 		SetOnConnectHandler(func(client paho.Client) {
 			c.mu.Lock()
 			c.connected = true
+			c.session++
 			c.mu.Unlock()
 			fmt.Printf("[MQTT Client] Connected successfully to %s\n", broker)
 			// Restart heartbeat on every successful (re)connection
 			c.restartHeartbeat()
+			// The session is clean, so subscriptions are made again
+			c.subscribeV3(client)
 		})
 
+	if c.statusSource != nil {
+		opts.SetBinaryWill(c.statusTopic(), c.statusPayload(statusOffline), 1, true)
+	}
 	if c.config.User != "" {
 		opts.SetUsername(c.config.User)
 	}
 	if c.config.Password != "" {
 		opts.SetPassword(c.config.Password)
 	}
+	if tlsCfg != nil {
+		opts.SetTLSConfig(tlsCfg)
+	}
 
 	client := paho.NewClient(opts)
 
@@ -101,31 +182,32 @@ func (c *Client) Connect() error {
 	c.connected = true
 	fmt.Printf("[MQTT Client] Connection established to %s\n", broker)
 
-	// Start heartbeat for the initial connection
-	c.restartHeartbeat()
-
+	// The heartbeat starts from the OnConnect handler, which also runs
+	// for the initial connection
 	return nil
 }
 
-// Disconnect closes the MQTT connection
+// Disconnect closes the MQTT connection. A clean disconnect does not
+// trigger the Last Will, so the offline status is published first.
 func (c *Client) Disconnect() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
 	// Stop heartbeat goroutine if channel is open
-	if c.stopHeartbeat != nil {
-		select {
-		case <-c.stopHeartbeat:
-			// Already closed
-		default:
-			close(c.stopHeartbeat)
-		}
+	c.hbMu.Lock()
+	c.closeHeartbeat()
+	c.hbMu.Unlock()
+	if c.statusSource != nil && c.IsConnectionOpen() {
+		c.publishStatus(statusOffline)
 	}
 
+	c.mu.Lock()
 	if c.client != nil && c.client.IsConnected() {
 		c.client.Disconnect(1000)
 	}
 	c.connected = false
+	c.mu.Unlock()
+
+	// autopaho runs the connection callbacks, which take c.mu, on the
+	// goroutine Disconnect waits for
+	c.disconnectV5()
 }
 
 // IsConnected returns the connection status
@@ -133,17 +215,142 @@ func (c *Client) IsConnected() bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
+	if c.isV5() {
+		return c.connected
+	}
 	if c.client == nil {
 		return false
 	}
 	return c.client.IsConnected()
 }
 
-// GetClient returns the underlying paho client
-func (c *Client) GetClient() paho.Client {
+// IsConnectionOpen reports whether the broker connection is actually up.
+// Unlike IsConnected it returns false while paho is still retrying.
+func (c *Client) IsConnectionOpen() bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	return c.client
+
+	if c.isV5() {
+		return c.connected
+	}
+	if c.client == nil {
+		return false
+	}
+	return c.client.IsConnectionOpen()
+}
+
+// Session identifies the current broker connection; it changes on
+// every reconnect
+func (c *Client) Session() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.session
+}
+
+// Publish sends msg with the configured protocol. QoS 0 is fire and
+// forget; QoS 1 and 2 wait up to inflightHold for the broker to
+// acknowledge. Publishes wait for mqtt.rateLimitMessages/rateLimitBytes,
+// and QoS 1 and 2 for a free slot among mqtt.maxInFlight unacknowledged
+// messages.
+func (c *Client) Publish(msg Message) error {
+	return c.publish(msg, true)
+}
+
+// publishControl is Publish outside the flow control, for the status,
+// command replies and state clears, which must not queue behind a
+// replay
+func (c *Client) publishControl(msg Message) error {
+	return c.publish(msg, false)
+}
+
+// publish sends msg, paced by the flow control if limited
+func (c *Client) publish(msg Message, limited bool) error {
+	if !c.IsConnected() {
+		return fmt.Errorf("MQTT client not connected")
+	}
+	held := limited && msg.QoS > 0
+	if limited {
+		c.flow.take(len(msg.Payload))
+	}
+	if held {
+		c.flow.acquire()
+	}
+	// Control messages are not retried by an outbox, so they need not
+	// wait out a slow acknowledgement
+	timeout, abort := inflightHold, c.flow.lifted
+	if !limited {
+		timeout, abort = controlTimeout, nil
+	}
+	if c.isV5() {
+		// paho also holds back publishes beyond the broker's Receive Maximum
+		if held {
+			defer c.flow.release()
+		}
+		return c.publishV5(msg, timeout, abort)
+	}
+
+	c.mu.RLock()
+	client := c.client
+	c.mu.RUnlock()
+
+	token := client.Publish(msg.Topic, msg.QoS, msg.Retained, msg.Payload)
+
+	// For QoS 0, don't wait (fire and forget)
+	if msg.QoS == 0 {
+		// Just check if publish was initiated, don't wait for completion
+		go func() {
+			if token.Error() != nil {
+				log.Printf("[MQTT] Async publish error for topic %s: %v", msg.Topic, token.Error())
+			}
+		}()
+		return nil
+	}
+
+	// For QoS 1+, wait for the acknowledgement. paho keeps sending the
+	// message until it comes, so a slow one is not reported as failed:
+	// the outbox would publish it again.
+	select {
+	case <-token.Done():
+	case <-time.After(timeout):
+	case <-abort:
+		// Shutting down: give the acknowledgement a moment only
+		token.WaitTimeout(controlTimeout)
+	}
+	select {
+	case <-token.Done():
+	default:
+		// The message stays in flight until paho gets the acknowledgement
+		if held {
+			go func() {
+				token.WaitTimeout(inflightHold)
+				c.flow.release()
+			}()
+		}
+		log.Printf("[MQTT] Timeout publishing to %s (payload size: %d bytes)", msg.Topic, len(msg.Payload))
+		return fmt.Errorf("publish timeout after %s for topic %s", timeout, msg.Topic)
+	}
+	if held {
+		c.flow.release()
+	}
+
+	if token.Error() != nil {
+		return fmt.Errorf("failed to publish to %s: %w", msg.Topic, token.Error())
+	}
+
+	return nil
+}
+
+// protocolName returns the MQTT version in use, for logs
+func (c *Client) protocolName() string {
+	if c.isV5() {
+		return "5"
+	}
+	return "3.1.1"
+}
+
+// FlowStatus reports the rate limits and in-flight window of the client
+func (c *Client) FlowStatus() FlowStatus {
+	return c.flow.status()
 }
 
 // GetConfig returns the MQTT configuration
@@ -151,62 +358,57 @@ func (c *Client) GetConfig() config.MQTTConfig {
 	return c.config
 }
 
-// startHeartbeat sends periodic heartbeat messages to MQTT broker
-func (c *Client) startHeartbeat() {
-	ticker := time.NewTicker(30 * time.Second)
+// startHeartbeat publishes the online status at once, then at every
+// mqtt.heartbeatIntervalSec until stop is closed
+func (c *Client) startHeartbeat(stop <-chan struct{}) {
+	interval := defaultHeartbeatInterval
+	if c.config.HeartbeatIntervalSec > 0 {
+		interval = time.Duration(c.config.HeartbeatIntervalSec) * time.Second
+	}
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
+	c.sendHeartbeat(stop)
 	for {
 		select {
 		case <-ticker.C:
-			c.sendHeartbeat()
-		case <-c.stopHeartbeat:
+			c.sendHeartbeat(stop)
+		case <-stop:
 			log.Printf("[MQTT Heartbeat] Stopped")
 			return
 		}
 	}
 }
 
-// sendHeartbeat sends a single heartbeat message
-func (c *Client) sendHeartbeat() {
-	if c.client == nil || !c.client.IsConnected() {
+// sendHeartbeat sends a single heartbeat message. It holds c.hbMu so
+// that Disconnect's offline status cannot be overtaken by a late online.
+func (c *Client) sendHeartbeat(stop <-chan struct{}) {
+	c.hbMu.Lock()
+	defer c.hbMu.Unlock()
+	select {
+	case <-stop:
 		return
+	default:
 	}
-
-	heartbeat := map[string]interface{}{
-		"status":    "connected",
-		"timestamp": time.Now().Format(time.RFC3339),
-		"clientId":  c.config.ClientID,
-		"version":   "1.0",
-	}
-
-	payload, err := json.Marshal(heartbeat)
-	if err != nil {
+	if !c.IsConnected() {
 		return
 	}
-
-	topicPrefix := c.config.TopicPrefix
-	if topicPrefix == "" {
-		topicPrefix = "feeding/mowi" // default
+	if err := c.publishStatus(statusOnline); err != nil {
+		log.Printf("[MQTT Heartbeat] Failed to send to %s: %v", c.statusTopic(), err)
+		return
 	}
-	topic := topicPrefix + "/status"
-	
-	// Fire-and-forget with QoS 0
-	token := c.client.Publish(topic, 0, false, payload)
-	token.Wait() // Don't block - just ensure message is queued
-	
-	log.Printf("[MQTT Heartbeat] ✓ Sent to %s", topic)
+	log.Printf("[MQTT Heartbeat] ✓ Sent to %s", c.statusTopic())
 }
 
 // TestConnection tests the MQTT connection
 func (c *Client) TestConnection() error {
-	if c.client == nil {
+	if c.client == nil && c.v5 == nil {
 		if err := c.Connect(); err != nil {
 			return err
 		}
 	}
 
-	if !c.client.IsConnected() {
+	if !c.IsConnected() {
 		return fmt.Errorf("not connected to MQTT broker")
 	}
 
@@ -0,0 +1,109 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+)
+
+// Commands accepted on {topicPrefix}/cmd/{command}
+const (
+	CommandStart   = "start"
+	CommandStop    = "stop"
+	CommandPollNow = "poll-now"
+	CommandReplay  = "replay"
+	CommandStatus  = "status"
+)
+
+// Command is a remote-control request. The payload is a JSON object;
+// the command name comes from the topic.
+type Command struct {
+	Name   string `json:"-"`
+	ID     string `json:"id"`     // Chosen by the sender, echoed in the reply
+	APIKey string `json:"apiKey"` // Omnipoll API key (opk_...)
+	From   string `json:"from"`   // replay: RFC3339 start of the fechaHora range
+	To     string `json:"to"`     // replay: RFC3339 end of the range
+}
+
+// CommandReply is published once a command has run or was rejected
+type CommandReply struct {
+	ID        string      `json:"id,omitempty"`
+	Command   string      `json:"command"`
+	OK        bool        `json:"ok"`
+	Error     string      `json:"error,omitempty"`
+	Result    interface{} `json:"result,omitempty"`
+	Timestamp string      `json:"timestamp"`
+
+	// Authenticated is set by the handler once the API key is valid;
+	// only then is the MQTT 5 response topic of the request honoured
+	Authenticated bool `json:"-"`
+}
+
+// CommandHandler authorizes and runs a command
+type CommandHandler func(cmd Command) CommandReply
+
+// maxConcurrentCommands bounds the commands handled at once; commands
+// arriving while all are busy are dropped
+const maxConcurrentCommands = 4
+
+// ServeCommands subscribes to {topicPrefix}/cmd/# and publishes the
+// reply of handler to {topicPrefix}/reply/{command}, or to the MQTT 5
+// response topic of an authenticated request, if it is under
+// {topicPrefix}/reply/, with its correlation data. Call it before
+// Connect.
+func (c *Client) ServeCommands(handler CommandHandler) {
+	c.subscribe(c.topicPrefix()+"/cmd/#", 1, maxConcurrentCommands, func(msg Message) {
+		c.runCommand(msg, handler)
+	})
+}
+
+// runCommand handles one message of the command topic
+func (c *Client) runCommand(msg Message, handler CommandHandler) {
+	// A retained command would run again on every reconnect
+	if msg.Retained {
+		log.Printf("[MQTT Commands] Ignoring retained message on %s", msg.Topic)
+		return
+	}
+
+	cmd := Command{}
+	name := strings.TrimPrefix(msg.Topic, c.topicPrefix()+"/cmd/")
+	var reply CommandReply
+	if err := json.Unmarshal(msg.Payload, &cmd); err != nil {
+		reply = CommandReply{Error: "invalid command payload: " + err.Error()}
+	} else {
+		cmd.Name = name
+		reply = handler(cmd)
+	}
+	reply.ID = cmd.ID
+	reply.Command = name
+	reply.Timestamp = time.Now().UTC().Format(time.RFC3339)
+
+	data, err := json.Marshal(reply)
+	if err != nil {
+		log.Printf("[MQTT Commands] Failed to encode reply to %s: %v", name, err)
+		return
+	}
+	out := Message{
+		Topic:      c.topicPrefix() + "/reply/" + name,
+		QoS:        1,
+		Payload:    data,
+		Properties: &Properties{ContentType: contentTypeJSON},
+	}
+	if p := msg.Properties; p != nil && reply.Authenticated &&
+		strings.HasPrefix(p.ResponseTopic, c.topicPrefix()+"/reply/") {
+		out.Topic = p.ResponseTopic
+		out.Properties.CorrelationData = p.CorrelationData
+	}
+	if err := c.publishControl(out); err != nil {
+		log.Printf("[MQTT Commands] Failed to reply to %s: %v", name, err)
+	}
+}
+
+// topicPrefix returns mqtt.topicPrefix or its default
+func (c *Client) topicPrefix() string {
+	if c.config.TopicPrefix == "" {
+		return defaultTopicPrefix
+	}
+	return c.config.TopicPrefix
+}
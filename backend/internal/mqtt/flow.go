@@ -0,0 +1,157 @@
+package mqtt
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/omnipoll/backend/internal/config"
+)
+
+const (
+	// inflightHold is how long a QoS 1/2 publish waits for its
+	// acknowledgement before it counts as failed, and how much longer a
+	// failed one keeps its in-flight slot while paho still waits
+	inflightHold = 30 * time.Second
+	// controlTimeout is how long a control publish (status, command
+	// reply, state clear) waits for its acknowledgement
+	controlTimeout = 2 * time.Second
+	// throttleLogInterval limits the "rate limit reached" log lines
+	throttleLogInterval = time.Minute
+)
+
+// flowControl paces the publishes of a client: token buckets for
+// mqtt.rateLimitMessages and mqtt.rateLimitBytes per second, refilled
+// continuously with up to one second of burst, and a window of
+// mqtt.maxInFlight unacknowledged QoS 1/2 messages.
+type flowControl struct {
+	name     string  // host:port, for logs
+	msgRate  float64 // Messages per second, 0 = unlimited
+	byteRate float64 // Bytes per second, 0 = unlimited
+	inflight chan struct{}
+	lifted   chan struct{} // Closed once the limits no longer apply
+
+	mu         sync.Mutex
+	msgTokens  float64
+	byteTokens float64 // May go negative: a large message is paid for after it is sent
+	refilled   time.Time
+	waiting    int           // Publishes waiting for tokens
+	throttled  time.Duration // Total time publishes waited for tokens
+	lastLog    time.Time
+	liftOnce   sync.Once
+}
+
+// FlowStatus is the rate limit and in-flight state of a client
+type FlowStatus struct {
+	Throttled        bool    // Publishes are waiting for the rate limit
+	ThrottledSeconds float64 // Time publishes waited for the rate limit since start
+	InFlight         int     // Unacknowledged QoS 1/2 messages
+	MaxInFlight      int
+}
+
+// newFlowControl creates the flow control of a broker
+func newFlowControl(name string, cfg config.MQTTConfig) *flowControl {
+	window := cfg.MaxInFlight
+	if window < 1 {
+		window = 1
+	}
+	f := &flowControl{
+		name:     name,
+		msgRate:  float64(cfg.RateLimitMessages),
+		byteRate: float64(cfg.RateLimitBytes),
+		inflight: make(chan struct{}, window),
+		lifted:   make(chan struct{}),
+		refilled: time.Now(),
+	}
+	f.msgTokens, f.byteTokens = f.msgRate, f.byteRate
+	return f
+}
+
+// take waits until the rate limits allow a message of size bytes
+func (f *flowControl) take(size int) {
+	if f.msgRate <= 0 && f.byteRate <= 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for {
+		now := time.Now()
+		elapsed := now.Sub(f.refilled).Seconds()
+		f.refilled = now
+		if f.msgRate > 0 {
+			f.msgTokens = min(f.msgTokens+elapsed*f.msgRate, max(f.msgRate, 1))
+		}
+		if f.byteRate > 0 {
+			f.byteTokens = min(f.byteTokens+elapsed*f.byteRate, f.byteRate)
+		}
+
+		var wait time.Duration
+		if f.msgRate > 0 && f.msgTokens < 1 {
+			wait = seconds((1 - f.msgTokens) / f.msgRate)
+		}
+		if f.byteRate > 0 && f.byteTokens < 0 {
+			wait = max(wait, seconds(-f.byteTokens/f.byteRate))
+		}
+		if wait == 0 {
+			f.msgTokens--
+			f.byteTokens -= float64(size)
+			return
+		}
+
+		if now.Sub(f.lastLog) >= throttleLogInterval {
+			log.Printf("[MQTT] Rate limit reached, throttling publishes to %s", f.name)
+			f.lastLog = now
+		}
+		f.waiting++
+		f.mu.Unlock()
+		select {
+		case <-time.After(wait):
+		case <-f.lifted:
+		}
+		f.mu.Lock()
+		f.waiting--
+		f.throttled += time.Since(now)
+
+		select {
+		case <-f.lifted:
+			return
+		default:
+		}
+	}
+}
+
+// acquire waits for an in-flight slot; release gives it back
+func (f *flowControl) acquire() {
+	select {
+	case f.inflight <- struct{}{}:
+	case <-f.lifted:
+	}
+}
+
+func (f *flowControl) release() {
+	select {
+	case <-f.inflight:
+	default:
+	}
+}
+
+// lift stops limiting publishes, so that a sender can finish at shutdown
+func (f *flowControl) lift() {
+	f.liftOnce.Do(func() { close(f.lifted) })
+}
+
+// status reports the current throttling and in-flight messages
+func (f *flowControl) status() FlowStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return FlowStatus{
+		Throttled:        f.waiting > 0,
+		ThrottledSeconds: f.throttled.Seconds(),
+		InFlight:         len(f.inflight),
+		MaxInFlight:      cap(f.inflight),
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -1,26 +1,100 @@
 package mqtt
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"regexp"
-	"strings"
 	"time"
 
+	"github.com/omnipoll/backend/internal/config"
 	"github.com/omnipoll/backend/internal/events"
+	"github.com/omnipoll/backend/internal/payload"
+)
+
+// Metadata attached to every event as MQTT 5 properties
+const (
+	contentTypeJSON      = "application/json"
+	messageSource        = "omnipoll"
+	messagePipeline      = "akva-detalle" // Akva TB_DetalleAlimentacion -> MQTT
+	messageSchemaVersion = "1"            // Version of the MQTTMessage layout
+	eventKindFeeding     = "feeding.detail"
 )
 
 // Publisher handles MQTT message publishing
 type Publisher struct {
-	client *Client
+	client    *Client
+	outputs   []output
+	sparkplug *Sparkplug // Set in sparkplug mode, instead of outputs
+}
+
+// output is a payload profile, its encoding and the topics it is
+// published to
+type output struct {
+	profile string
+	topics  *TopicBuilder
+	record  func(event events.NormalizedEvent) payload.Record
+	codec   *payload.Codec
 }
 
-// NewPublisher creates a new MQTT publisher
+// NewPublisher creates a new MQTT publisher. In Sparkplug mode it
+// subscribes to the node commands, so call it before Connect.
 func NewPublisher(client *Client) *Publisher {
-	return &Publisher{
-		client: client,
+	p := &Publisher{client: client}
+
+	cfg := client.GetConfig()
+	if cfg.Mode == "sparkplug" {
+		p.sparkplug = NewSparkplug(client, cfg)
+		return p
+	}
+	profiles := cfg.PayloadProfiles
+	if len(profiles) == 0 {
+		profiles = []payload.Profile{{Name: payload.Legacy}}
+	}
+	for _, profile := range profiles {
+		out, err := p.newOutput(cfg, profile)
+		if err != nil {
+			// Validation rejects bad profiles before they get here
+			log.Printf("[MQTT] Skipping payload profile %q: %v", profile.Name, err)
+			continue
+		}
+		p.outputs = append(p.outputs, out)
+	}
+	return p
+}
+
+// newOutput compiles a payload profile and its topic
+func (p *Publisher) newOutput(cfg config.MQTTConfig, profile payload.Profile) (output, error) {
+	out := output{profile: profile.Name, record: p.legacyPayload}
+	codec, err := payload.NewCodec(profile.Encoding)
+	if err != nil {
+		return out, err
+	}
+	out.codec = codec
+
+	if profile.TopicTemplate != "" {
+		cfg.TopicTemplate = profile.TopicTemplate
+	}
+	topics, err := NewTopicBuilder(cfg)
+	if err != nil {
+		return out, err
 	}
+	topics.vars.Encoding = codec.Name()
+	out.topics = topics
+
+	switch {
+	case profile.IsLegacy():
+	case codec.Name() == payload.EncodingProtobuf:
+		// The .proto schema is the whole event
+		out.record = payload.EventRecord
+	default:
+		enc, err := payload.Compile(profile)
+		if err != nil {
+			return out, err
+		}
+		out.record = enc.Record
+	}
+	return out, nil
 }
 
 // MQTTMessage represents the message format for MQTT (all fields from TB_DetalleAlimentacion)
@@ -48,23 +122,6 @@ type MQTTMessage struct {
 	TimeStampIngresado  string  `json:"TimeStampIngresado"`  // IngestedAt
 }
 
-// buildDynamicTopic creates topic: {topicPrefix}/{centro}/
-func (p *Publisher) buildDynamicTopic(centerName string) string {
-	// Normalize center name: lowercase, replace spaces with underscores
-	normalized := strings.ToLower(centerName)
-	normalized = strings.ReplaceAll(normalized, " ", "_")
-	// Remove special characters except underscores
-	reg := regexp.MustCompile(`[^a-z0-9_]`)
-	normalized = reg.ReplaceAllString(normalized, "")
-	
-	topicPrefix := p.client.config.TopicPrefix
-	if topicPrefix == "" {
-		topicPrefix = "feeding/mowi" // default
-	}
-	
-	return fmt.Sprintf("%s/%s/", topicPrefix, normalized)
-}
-
 // cleanJaula removes letters, spaces, and special characters from unit name
 func (p *Publisher) cleanJaula(unitName string) string {
 	// Keep only digits
@@ -72,18 +129,45 @@ func (p *Publisher) cleanJaula(unitName string) string {
 	return reg.ReplaceAllString(unitName, "")
 }
 
-// Publish publishes a single event to MQTT with dynamic topic
+// Publish publishes a single event to MQTT, once per payload profile
 func (p *Publisher) Publish(event events.NormalizedEvent) error {
-	client := p.client.GetClient()
 	cfg := p.client.GetConfig()
 	
-	if client == nil || !client.IsConnected() {
+	if !p.client.IsConnected() {
 		return fmt.Errorf("MQTT client not connected")
 	}
+	if p.sparkplug != nil {
+		return p.sparkplug.Publish(event)
+	}
 
-	// Build dynamic topic based on center name
-	topic := p.buildDynamicTopic(event.Name)
-	
+	var errs []error
+	for _, out := range p.outputs {
+		topic, err := out.topics.Topic(event)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		data, err := out.codec.Marshal(out.record(event))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("payload profile %s: %w", out.profile, err))
+			continue
+		}
+		err = p.client.Publish(Message{
+			Topic:      topic,
+			QoS:        cfg.QoS,
+			Payload:    out.codec.Message([][]byte{data}, false),
+			Properties: p.eventProperties(event, out, false),
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// legacyPayload renders the event in the MQTTMessage layout of the
+// built-in "legacy" profile
+func (p *Publisher) legacyPayload(event events.NormalizedEvent) payload.Record {
 	// Transform to MQTT message format with ALL fields
 	msg := MQTTMessage{
 		ID:                 event.ID,
@@ -109,71 +193,36 @@ func (p *Publisher) Publish(event events.NormalizedEvent) error {
 		TimeStampIngresado: event.IngestedAt.Format(time.RFC3339),
 	}
 
-	payload, err := json.Marshal(msg)
-	if err != nil {
-		return fmt.Errorf("failed to marshal event: %w", err)
-	}
-
-	token := client.Publish(topic, cfg.QoS, false, payload)
-	
-	// For QoS 0, don't wait (fire and forget)
-	if cfg.QoS == 0 {
-		// Just check if publish was initiated, don't wait for completion
-		go func() {
-			if token.Error() != nil {
-				log.Printf("[MQTT] Async publish error for topic %s: %v", topic, token.Error())
-			}
-		}()
-		return nil
-	}
-	
-	// For QoS 1+, wait with timeout and check result
-	if !token.WaitTimeout(2 * time.Second) {
-		log.Printf("[MQTT] Timeout publishing to %s (payload size: %d bytes)", topic, len(payload))
-		return fmt.Errorf("publish timeout after 2s for topic %s", topic)
-	}
-	
-	if token.Error() != nil {
-		return fmt.Errorf("failed to publish to %s: %w", topic, token.Error())
-	}
-
-	return nil
+	return payload.RecordOf(msg)
 }
 
-// PublishBatch publishes multiple events to MQTT
-func (p *Publisher) PublishBatch(evts []events.NormalizedEvent) error {
-	successCount := 0
-	errorCount := 0
-	total := len(evts)
+// eventProperties describes an event for MQTT 5 consumers. The event ID
+// is the correlation data, so replies on the response topic can be
+// matched to the event.
+func (p *Publisher) eventProperties(event events.NormalizedEvent, out output, batch bool) *Properties {
 	cfg := p.client.GetConfig()
-	
-	log.Printf("[MQTT] Publishing %d events to %s:%d (QoS: %d)", total, cfg.Broker, cfg.Port, cfg.QoS)
-	
-	for i, event := range evts {
-		if err := p.Publish(event); err != nil {
-			errorCount++
-			// Log first error only
-			if errorCount == 1 {
-				topic := p.buildDynamicTopic(event.Name)
-				log.Printf("[MQTT] First error - Topic: %s, Error: %v", topic, err)
-			}
-		} else {
-			successCount++
-		}
-		
-		// Log progress every 25 events
-		if (i+1)%25 == 0 {
-			log.Printf("[MQTT] Progress: %d/%d (%d ok, %d err)", i+1, total, successCount, errorCount)
-		}
+	return &Properties{
+		ContentType:     out.codec.ContentType(batch),
+		MessageExpiry:   uint32(cfg.MessageExpirySec),
+		ResponseTopic:   cfg.ResponseTopic,
+		CorrelationData: []byte(event.ID),
+		User: []UserProperty{
+			{Key: "source", Value: messageSource},
+			{Key: "pipeline", Value: messagePipeline},
+			{Key: "schemaVersion", Value: messageSchemaVersion},
+			{Key: "eventKind", Value: eventKindFeeding},
+			{Key: "payloadProfile", Value: out.profile},
+			{Key: "payloadEncoding", Value: out.codec.Name()},
+		},
 	}
-	
-	log.Printf("[MQTT] Complete: %d/%d published successfully", successCount, total)
-	
-	if errorCount > 0 {
-		return fmt.Errorf("published %d/%d events (%d errors)", successCount, len(evts), errorCount)
+}
+
+// Close ends the publisher's session: in sparkplug mode every edge node
+// is reported dead. Call it before disconnecting the client.
+func (p *Publisher) Close() {
+	if p.sparkplug != nil {
+		p.sparkplug.Close()
 	}
-	
-	return nil
 }
 
 // IsConnected returns whether the publisher is ready
@@ -0,0 +1,405 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/omnipoll/backend/internal/config"
+	"github.com/omnipoll/backend/internal/events"
+	"github.com/omnipoll/backend/internal/payload"
+	"github.com/omnipoll/backend/internal/topic"
+)
+
+const (
+	sparkplugNamespace    = "spBv1.0"
+	defaultSparkplugGroup = "omnipoll"
+	sparkplugRebirth      = "Node Control/Rebirth"
+	sparkplugBdSeq        = "bdSeq"
+)
+
+// errNoSparkplugID is returned for events without a centro or jaula,
+// which no retry can publish
+var errNoSparkplugID = errors.New("centro and jaula are required for Sparkplug")
+
+// Sparkplug B data types (org.eclipse.tahu.protobuf.DataType)
+const (
+	spInt64    = 4
+	spUInt64   = 8
+	spDouble   = 10
+	spBoolean  = 11
+	spString   = 12
+	spDateTime = 13
+)
+
+// Sparkplug publishes events as Sparkplug B: each centro is an edge node
+// and each jaula one of its devices. Births are sent before the first
+// data of a node or device on every connection; device metrics are
+// declared with aliases in DBIRTH and sent by alias in DDATA.
+//
+// An MQTT connection has a single Will, so it cannot carry the NDEATH of
+// every centro. Instead the NDEATHs of the previous connection are sent
+// when it is replaced, and on Close; a crash emits none until Omnipoll
+// reconnects.
+//
+// A "Node Control/Rebirth" NCMD makes a born node send its NBIRTH and the
+// DBIRTHs of its devices again, with the last event of each device.
+type Sparkplug struct {
+	client *Client
+	group  string
+
+	mu      sync.Mutex
+	session uint64 // Client session the nodes were born in
+	bdSeq   uint64
+	nodes   map[string]*sparkplugNode
+}
+
+// sparkplugNode is a born edge node
+type sparkplugNode struct {
+	seq     uint64                            // Sequence number of the next message
+	devices map[string]events.NormalizedEvent // Born devices and their last event
+}
+
+// spMetric is one Sparkplug metric
+type spMetric struct {
+	name      string // Empty when sent by alias
+	alias     uint64 // 0 = none (node metrics)
+	timestamp uint64 // Unix ms, 0 = unset
+	datatype  uint32
+	value     interface{} // nil = is_null
+}
+
+// NewSparkplug creates the Sparkplug B publisher of a client and
+// subscribes to the node commands, so call it before Connect
+func NewSparkplug(client *Client, cfg config.MQTTConfig) *Sparkplug {
+	group := cfg.SparkplugGroupID
+	if group == "" {
+		group = defaultSparkplugGroup
+	}
+	s := &Sparkplug{client: client, group: group, nodes: make(map[string]*sparkplugNode)}
+	client.Subscribe(s.topic("NCMD", "+", ""), 0, s.handleCommand)
+	return s
+}
+
+// Publish sends the event as DDATA of its jaula, after the NBIRTH and
+// DBIRTH it needs
+func (s *Sparkplug) Publish(event events.NormalizedEvent) error {
+	slug, _ := topic.Func("slug")
+	nodeID, deviceID := slug(event.Name), slug(event.UnitName)
+	if nodeID == "" || deviceID == "" {
+		return fmt.Errorf("event %s: %w", event.ID, errNoSparkplugID)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.checkSession()
+	node, ok := s.nodes[nodeID]
+	if !ok {
+		node = &sparkplugNode{devices: make(map[string]events.NormalizedEvent)}
+		if err := s.send(s.topic("NBIRTH", nodeID, ""), s.nodeBirth(), 0); err != nil {
+			return err
+		}
+		node.seq = 1
+		s.nodes[nodeID] = node
+	}
+
+	kind := "DDATA"
+	if _, born := node.devices[deviceID]; !born {
+		kind = "DBIRTH"
+	}
+	metrics := deviceMetrics(event, kind == "DBIRTH")
+	if err := s.send(s.topic(kind, nodeID, deviceID), metrics, node.seq); err != nil {
+		return err
+	}
+	node.seq = (node.seq + 1) % 256
+	node.devices[deviceID] = event
+	return nil
+}
+
+// handleCommand acts on an NCMD: a rebirth request makes the node send
+// its births again
+func (s *Sparkplug) handleCommand(msg Message) {
+	nodeID := msg.Topic[strings.LastIndex(msg.Topic, "/")+1:]
+	if !rebirthRequested(msg.Payload) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkSession()
+	if err := s.rebirth(nodeID); err != nil {
+		log.Printf("[Sparkplug] Rebirth of %s: %v", nodeID, err)
+		return
+	}
+	log.Printf("[Sparkplug] Rebirth of %s requested", nodeID)
+}
+
+// rebirth sends the NBIRTH of a node, with seq 0, and the DBIRTH of each
+// of its devices. A node that is not born has nothing to send; it is
+// born with its next event, as is a node whose rebirth failed. Called
+// with s.mu held.
+func (s *Sparkplug) rebirth(nodeID string) error {
+	node, ok := s.nodes[nodeID]
+	if !ok {
+		return nil
+	}
+	if err := s.send(s.topic("NBIRTH", nodeID, ""), s.nodeBirth(), 0); err != nil {
+		delete(s.nodes, nodeID)
+		return err
+	}
+	node.seq = 1
+	for deviceID, event := range node.devices {
+		if err := s.send(s.topic("DBIRTH", nodeID, deviceID), deviceMetrics(event, true), node.seq); err != nil {
+			delete(s.nodes, nodeID)
+			return err
+		}
+		node.seq = (node.seq + 1) % 256
+	}
+	return nil
+}
+
+// publishBatch publishes events one by one, in order, and reports which
+// failed, as the single profile of sparkplug mode. Sparkplug has no batch
+// messages; mqtt.batchMaxEvents and mqtt.maxInFlight do not apply.
+func (s *Sparkplug) publishBatch(evts []events.NormalizedEvent) ([]profileSet, error) {
+	failed := make([]profileSet, len(evts))
+	errorCount := 0
+	for i, event := range evts {
+		if err := s.Publish(event); errors.Is(err, errNoSparkplugID) {
+			log.Printf("[Sparkplug] Skipping %v", err)
+		} else if err != nil {
+			failed[i] = profileSet{true}
+			errorCount++
+			// Log first error only
+			if errorCount == 1 {
+				log.Printf("[Sparkplug] First error - Event: %s, Error: %v", event.ID, err)
+			}
+		}
+	}
+	log.Printf("[Sparkplug] Complete: %d/%d published successfully", len(evts)-errorCount, len(evts))
+
+	if errorCount > 0 {
+		return failed, fmt.Errorf("published %d/%d events (%d errors)", len(evts)-errorCount, len(evts), errorCount)
+	}
+	return failed, nil
+}
+
+// Close sends NDEATH for every born node
+func (s *Sparkplug) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deathAll()
+}
+
+// checkSession starts over after a reconnect: the nodes of the previous
+// connection die and are born again, with the next bdSeq, on their next
+// event. Called with s.mu held.
+func (s *Sparkplug) checkSession() {
+	session := s.client.Session()
+	if session == s.session {
+		return
+	}
+	if s.session != 0 {
+		s.deathAll()
+		s.bdSeq = (s.bdSeq + 1) % 256
+	}
+	s.session = session
+}
+
+// deathAll sends NDEATH for every born node and forgets them. Called
+// with s.mu held.
+func (s *Sparkplug) deathAll() {
+	for nodeID := range s.nodes {
+		death := []spMetric{{name: sparkplugBdSeq, datatype: spUInt64, value: s.bdSeq}}
+		if err := s.send(s.topic("NDEATH", nodeID, ""), death, math.MaxUint64); err != nil {
+			log.Printf("[Sparkplug] NDEATH for %s: %v", nodeID, err)
+		}
+	}
+	s.nodes = make(map[string]*sparkplugNode)
+}
+
+// nodeBirth returns the NBIRTH metrics
+func (s *Sparkplug) nodeBirth() []spMetric {
+	return []spMetric{
+		{name: sparkplugBdSeq, datatype: spUInt64, value: s.bdSeq},
+		{name: sparkplugRebirth, datatype: spBoolean, value: false},
+	}
+}
+
+// rebirthRequested reports whether an NCMD payload sets
+// "Node Control/Rebirth" to true
+func rebirthRequested(b []byte) bool {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return false
+		}
+		b = b[n:]
+		if num == 2 && typ == protowire.BytesType {
+			metric, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return false
+			}
+			b = b[n:]
+			if name, value, ok := decodeBoolMetric(metric); ok && name == sparkplugRebirth && value {
+				return true
+			}
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return false
+		}
+		b = b[n:]
+	}
+	return false
+}
+
+// decodeBoolMetric returns the name and boolean value of a
+// Payload.Metric message
+func decodeBoolMetric(b []byte) (name string, value, ok bool) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", false, false
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			s, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return "", false, false
+			}
+			name, b = s, b[n:]
+		case num == 14 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return "", false, false
+			}
+			value, ok, b = protowire.DecodeBool(v), true, b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return "", false, false
+			}
+			b = b[n:]
+		}
+	}
+	return name, value, ok
+}
+
+// topic returns spBv1.0/{group}/{kind}/{node}[/{device}]
+func (s *Sparkplug) topic(kind, nodeID, deviceID string) string {
+	t := fmt.Sprintf("%s/%s/%s/%s", sparkplugNamespace, s.group, kind, nodeID)
+	if deviceID != "" {
+		t += "/" + deviceID
+	}
+	return t
+}
+
+// send publishes a Sparkplug payload at QoS 0, as the specification
+// requires for births and data. seq math.MaxUint64 leaves it out (NDEATH).
+func (s *Sparkplug) send(topic string, metrics []spMetric, seq uint64) error {
+	return s.client.Publish(Message{
+		Topic:   topic,
+		Payload: sparkplugPayload(metrics, seq),
+		Properties: &Properties{
+			ContentType: "application/x-protobuf; messageType=org.eclipse.tahu.protobuf.Payload",
+		},
+	})
+}
+
+// deviceMetrics returns the event fields as metrics, aliased by their
+// position in NormalizedEvent. Births also carry the names.
+func deviceMetrics(event events.NormalizedEvent, birth bool) []spMetric {
+	var ts uint64
+	if t, err := time.Parse(time.RFC3339, event.FechaHora); err == nil {
+		ts = uint64(t.UnixMilli())
+	}
+
+	record := payload.EventRecord(event)
+	metrics := make([]spMetric, 0, len(record))
+	for i, m := range record {
+		metric := spMetric{alias: uint64(i + 1), timestamp: ts}
+		if birth {
+			metric.name = m.Key
+		}
+		switch v := m.Value.(type) {
+		case string:
+			metric.datatype, metric.value = spString, v
+		case int:
+			metric.datatype, metric.value = spInt64, uint64(int64(v))
+		case float64:
+			metric.datatype, metric.value = spDouble, v
+		case time.Time:
+			metric.datatype = spDateTime
+			if !v.IsZero() {
+				metric.value = uint64(v.UnixMilli())
+			}
+		default:
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics
+}
+
+// sparkplugPayload encodes an org.eclipse.tahu.protobuf.Payload
+func sparkplugPayload(metrics []spMetric, seq uint64) []byte {
+	b := protowire.AppendTag(nil, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(time.Now().UnixMilli()))
+	for _, m := range metrics {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.encode())
+	}
+	if seq != math.MaxUint64 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, seq)
+	}
+	return b
+}
+
+// encode returns the Payload.Metric message
+func (m spMetric) encode() []byte {
+	var b []byte
+	if m.name != "" {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, m.name)
+	}
+	if m.alias != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.alias)
+	}
+	if m.timestamp != 0 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.timestamp)
+	}
+	b = protowire.AppendTag(b, 4, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(m.datatype))
+
+	switch v := m.value.(type) {
+	case nil:
+		b = protowire.AppendTag(b, 7, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	case uint64: // Int64, UInt64, DateTime
+		b = protowire.AppendTag(b, 11, protowire.VarintType)
+		b = protowire.AppendVarint(b, v)
+	case float64:
+		b = protowire.AppendTag(b, 13, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(v))
+	case bool:
+		b = protowire.AppendTag(b, 14, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	case string:
+		b = protowire.AppendTag(b, 15, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	}
+	return b
+}
@@ -0,0 +1,111 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/omnipoll/backend/internal/events"
+	"github.com/omnipoll/backend/internal/topic"
+)
+
+// JaulaState is the retained latest-state message of one jaula, for
+// consumers that connect after the events were published
+type JaulaState struct {
+	Centro      string      `json:"centro"`
+	Jaula       string      `json:"jaula"`
+	Dia         string      `json:"dia"`        // Day of the last feeding
+	TodayGrams  float64     `json:"todayGrams"` // Total fed on Dia
+	FeedName    string      `json:"feedName"`   // Current feed
+	SiloName    string      `json:"siloName"`   // Current silo
+	LastFeeding LastFeeding `json:"lastFeeding"`
+	UpdatedAt   string      `json:"updatedAt"` // RFC3339
+}
+
+// LastFeeding is the latest feeding event of a jaula
+type LastFeeding struct {
+	ID          string  `json:"id"`
+	FechaHora   string  `json:"fechaHora"`
+	Inicio      string  `json:"inicio"`
+	Fin         string  `json:"fin"`
+	AmountGrams float64 `json:"amountGrams"`
+	DoserName   string  `json:"doserName"`
+}
+
+// NewJaulaState builds the state of a jaula from its latest event and
+// the grams fed that day
+func NewJaulaState(last events.NormalizedEvent, todayGrams float64) JaulaState {
+	return JaulaState{
+		Centro:     last.Name,
+		Jaula:      last.UnitName,
+		Dia:        last.Dia,
+		TodayGrams: todayGrams,
+		FeedName:   last.FeedName,
+		SiloName:   last.SiloName,
+		LastFeeding: LastFeeding{
+			ID:          last.ID,
+			FechaHora:   last.FechaHora,
+			Inicio:      last.Inicio,
+			Fin:         last.Fin,
+			AmountGrams: last.AmountGrams,
+			DoserName:   last.DoserName,
+		},
+		UpdatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// StateEnabled reports whether mqtt.stateTopic is set
+func (p *Publisher) StateEnabled() bool {
+	return p.client.GetConfig().StateTopic != ""
+}
+
+// PublishStates publishes retained latest-state messages
+func (p *Publisher) PublishStates(states []JaulaState) error {
+	var errs []error
+	for _, state := range states {
+		data, err := json.Marshal(state)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("state of %s/%s: %w", state.Centro, state.Jaula, err))
+			continue
+		}
+		if err := p.publishState(state.Centro, state.Jaula, data); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ClearState removes the retained state of a decommissioned jaula
+func (p *Publisher) ClearState(centro, jaula string) error {
+	return p.publishState(centro, jaula, nil)
+}
+
+// publishState sends a retained message to the state topic of a jaula;
+// an empty payload clears it
+func (p *Publisher) publishState(centro, jaula string, data []byte) error {
+	cfg := p.client.GetConfig()
+	if cfg.StateTopic == "" {
+		return fmt.Errorf("mqtt.stateTopic is not set")
+	}
+	tmpl, err := topic.Parse(cfg.StateTopic)
+	if err != nil {
+		return fmt.Errorf("invalid state topic: %w", err)
+	}
+	prefix := cfg.TopicPrefix
+	if prefix == "" {
+		prefix = defaultTopicPrefix
+	}
+	t, err := tmpl.Render(events.NormalizedEvent{Name: centro, UnitName: jaula}, topic.Vars{Prefix: prefix})
+	if err != nil {
+		return err
+	}
+
+	msg := Message{Topic: t, QoS: cfg.QoS, Retained: true, Payload: data}
+	if data == nil {
+		// A clear is an operator action, not part of the event flow
+		return p.client.publishControl(msg)
+	}
+	msg.Properties = &Properties{ContentType: contentTypeJSON}
+	return p.client.Publish(msg)
+}
@@ -0,0 +1,51 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Values of the "status" member of status messages
+const (
+	statusOnline  = "online"
+	statusOffline = "offline"
+)
+
+// defaultHeartbeatInterval applies when mqtt.heartbeatIntervalSec is unset
+const defaultHeartbeatInterval = 30 * time.Second
+
+// statusTopic returns {topicPrefix}/status
+func (c *Client) statusTopic() string {
+	return c.topicPrefix() + "/status"
+}
+
+// statusPayload renders a status message. Online messages carry the
+// worker report; the offline one is fixed at connect time as the Last
+// Will, so it has no timestamp.
+func (c *Client) statusPayload(status string) []byte {
+	msg := map[string]interface{}{
+		"status":   status,
+		"clientId": c.config.ClientID,
+		"version":  "1.0",
+	}
+	if status == statusOnline {
+		msg["timestamp"] = time.Now().Format(time.RFC3339)
+		if c.statusSource != nil {
+			msg["worker"] = c.statusSource()
+		}
+	}
+	data, _ := json.Marshal(msg)
+	return data
+}
+
+// publishStatus publishes the retained status message, ahead of any
+// rate-limited publishes
+func (c *Client) publishStatus(status string) error {
+	return c.publishControl(Message{
+		Topic:      c.statusTopic(),
+		QoS:        1,
+		Retained:   true,
+		Payload:    c.statusPayload(status),
+		Properties: &Properties{ContentType: contentTypeJSON},
+	})
+}
@@ -0,0 +1,149 @@
+package mqtt
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	paho5 "github.com/eclipse/paho.golang/paho"
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// dropLogInterval limits the "dropping message" log lines of a
+// subscription
+const dropLogInterval = time.Minute
+
+// subscription is a topic filter the client subscribes to on every
+// connection
+type subscription struct {
+	filter  string
+	qos     byte
+	handler func(Message)
+	slots   chan struct{} // Handlers running at once; nil = unbounded
+
+	mu      sync.Mutex
+	dropped int
+	lastLog time.Time
+}
+
+// Subscribe registers handler for messages matching filter. The
+// subscription is made on every (re)connection, so call it before
+// Connect. Each message is handled on its own goroutine, since paho
+// cannot process acknowledgements while a handler blocks.
+func (c *Client) Subscribe(filter string, qos byte, handler func(Message)) {
+	c.subscribe(filter, qos, 0, handler)
+}
+
+// subscribe is Subscribe with at most limit handlers running at once
+// (0 = no limit); messages beyond it are dropped
+func (c *Client) subscribe(filter string, qos byte, limit int, handler func(Message)) {
+	sub := &subscription{filter: filter, qos: qos, handler: handler}
+	if limit > 0 {
+		sub.slots = make(chan struct{}, limit)
+	}
+	c.subs = append(c.subs, sub)
+}
+
+// dispatch runs the handler of a message on its own goroutine, or drops
+// the message when the subscription has no free slot
+func (s *subscription) dispatch(msg Message) {
+	if s.slots == nil {
+		go s.handler(msg)
+		return
+	}
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		s.mu.Lock()
+		s.dropped++
+		if time.Since(s.lastLog) >= dropLogInterval {
+			log.Printf("[MQTT Client] %d handlers busy on %s, dropped %d messages", cap(s.slots), s.filter, s.dropped)
+			s.dropped, s.lastLog = 0, time.Now()
+		}
+		s.mu.Unlock()
+		return
+	}
+	go func() {
+		defer func() { <-s.slots }()
+		s.handler(msg)
+	}()
+}
+
+// subscribeV3 subscribes a 3.1.1 connection. Called from the OnConnect
+// handler, where c.client may not be set yet.
+func (c *Client) subscribeV3(client paho.Client) {
+	for _, sub := range c.subs {
+		sub := sub
+		token := client.Subscribe(sub.filter, sub.qos, func(_ paho.Client, m paho.Message) {
+			sub.dispatch(Message{Topic: m.Topic(), QoS: m.Qos(), Retained: m.Retained(), Payload: m.Payload()})
+		})
+		if !token.WaitTimeout(5 * time.Second) {
+			log.Printf("[MQTT Client] Timeout subscribing to %s", sub.filter)
+		} else if token.Error() != nil {
+			log.Printf("[MQTT Client] Failed to subscribe to %s: %v", sub.filter, token.Error())
+		} else {
+			log.Printf("[MQTT Client] Subscribed to %s", sub.filter)
+		}
+	}
+}
+
+// subscribeV5 subscribes an MQTT 5 connection. Messages arrive through
+// receiveV5.
+func (c *Client) subscribeV5(cm *autopaho.ConnectionManager) {
+	for _, sub := range c.subs {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := cm.Subscribe(ctx, &paho5.Subscribe{
+			Subscriptions: []paho5.SubscribeOptions{{Topic: sub.filter, QoS: sub.qos}},
+		})
+		cancel()
+		if err != nil {
+			log.Printf("[MQTT Client] Failed to subscribe to %s: %v", sub.filter, err)
+		} else {
+			log.Printf("[MQTT Client] Subscribed to %s", sub.filter)
+		}
+	}
+}
+
+// receiveV5 dispatches an incoming MQTT 5 publish to the matching
+// subscriptions
+func (c *Client) receiveV5(pr paho5.PublishReceived) (bool, error) {
+	p := pr.Packet
+	msg := Message{Topic: p.Topic, QoS: p.QoS, Retained: p.Retain, Payload: p.Payload}
+	if p.Properties != nil {
+		msg.Properties = &Properties{
+			ContentType:     p.Properties.ContentType,
+			ResponseTopic:   p.Properties.ResponseTopic,
+			CorrelationData: p.Properties.CorrelationData,
+		}
+		for _, up := range p.Properties.User {
+			msg.Properties.User = append(msg.Properties.User, UserProperty{Key: up.Key, Value: up.Value})
+		}
+	}
+
+	handled := false
+	for _, sub := range c.subs {
+		if topicMatches(sub.filter, msg.Topic) {
+			sub.dispatch(msg)
+			handled = true
+		}
+	}
+	return handled, nil
+}
+
+// topicMatches reports whether topic matches a filter with + and #
+// wildcards
+func topicMatches(filter, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
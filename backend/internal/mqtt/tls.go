@@ -0,0 +1,105 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/omnipoll/backend/internal/config"
+)
+
+// brokerURL builds the broker address for the configured transport.
+// Plain TCP switches to TLS when UseTLS is set or the port is 8883.
+func brokerURL(cfg config.MQTTConfig) string {
+	switch cfg.Transport {
+	case "ws", "wss":
+		path := cfg.WSPath
+		if path == "" {
+			path = "/mqtt"
+		}
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		return fmt.Sprintf("%s://%s:%d%s", cfg.Transport, cfg.Broker, cfg.Port, path)
+	default:
+		protocol := "tcp"
+		if usesTLS(cfg) {
+			protocol = "ssl"
+		}
+		return fmt.Sprintf("%s://%s:%d", protocol, cfg.Broker, cfg.Port)
+	}
+}
+
+// usesTLS reports whether the connection is encrypted
+func usesTLS(cfg config.MQTTConfig) bool {
+	switch cfg.Transport {
+	case "wss":
+		return true
+	case "ws":
+		return false
+	default:
+		return cfg.UseTLS || cfg.Port == 8883
+	}
+}
+
+// buildTLSConfig creates the TLS settings from the config: extra CA,
+// client certificate, server name, minimum version and verification
+func buildTLSConfig(cfg config.MQTTConfig) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.TLSServerName,
+		InsecureSkipVerify: cfg.TLSInsecureSkipVerify,
+	}
+	if cfg.TLSMinVersion == "1.3" {
+		tlsCfg.MinVersion = tls.VersionTLS13
+	}
+
+	if cfg.TLSCA != "" {
+		ca, err := loadPEM(cfg.TLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MQTT CA: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("MQTT CA contains no valid certificates")
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if cfg.TLSClientCert != "" || cfg.TLSClientKey != "" {
+		certPEM, err := loadPEM(cfg.TLSClientCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MQTT client certificate: %w", err)
+		}
+		keyPEM, err := loadPEM(cfg.TLSClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MQTT client key: %w", err)
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MQTT client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsCfg, nil
+}
+
+// loadPEM returns inline PEM as is, or reads it from the file at value
+func loadPEM(value string) ([]byte, error) {
+	if isInlinePEM(value) {
+		return []byte(value), nil
+	}
+	return os.ReadFile(value)
+}
+
+// isInlinePEM reports whether a certificate or key setting holds PEM data
+// rather than a file path
+func isInlinePEM(value string) bool {
+	return strings.Contains(value, "-----BEGIN")
+}
@@ -0,0 +1,58 @@
+package mqtt
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/omnipoll/backend/internal/config"
+	"github.com/omnipoll/backend/internal/events"
+	"github.com/omnipoll/backend/internal/payload"
+	"github.com/omnipoll/backend/internal/topic"
+)
+
+const defaultTopicPrefix = "feeding/mowi"
+
+var legacyCenterChars = regexp.MustCompile(`[^a-z0-9_]`)
+
+// TopicBuilder renders the topic an event is published to
+type TopicBuilder struct {
+	vars     topic.Vars
+	template *topic.Template // nil for the legacy {topicPrefix}/{centro}/ layout
+}
+
+// NewTopicBuilder creates the builder for mqtt.topicTemplate, or for the
+// legacy layout when no template is set
+func NewTopicBuilder(cfg config.MQTTConfig) (*TopicBuilder, error) {
+	b := &TopicBuilder{vars: topic.Vars{Prefix: cfg.TopicPrefix, Encoding: payload.EncodingJSON}}
+	if b.vars.Prefix == "" {
+		b.vars.Prefix = defaultTopicPrefix
+	}
+	if cfg.TopicTemplate != "" {
+		tmpl, err := topic.Parse(cfg.TopicTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid topic template: %w", err)
+		}
+		b.template = tmpl
+	}
+	return b, nil
+}
+
+// Topic returns the topic of an event
+func (b *TopicBuilder) Topic(event events.NormalizedEvent) (string, error) {
+	if b.template != nil {
+		return b.template.Render(event, b.vars)
+	}
+	return b.legacyTopic(event.Name), nil
+}
+
+// legacyTopic creates topic: {topicPrefix}/{centro}/
+func (b *TopicBuilder) legacyTopic(centerName string) string {
+	// Normalize center name: lowercase, replace spaces with underscores
+	normalized := strings.ToLower(centerName)
+	normalized = strings.ReplaceAll(normalized, " ", "_")
+	// Remove special characters except underscores
+	normalized = legacyCenterChars.ReplaceAllString(normalized, "")
+
+	return fmt.Sprintf("%s/%s/", b.vars.Prefix, normalized)
+}
@@ -0,0 +1,254 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	paho5 "github.com/eclipse/paho.golang/paho"
+)
+
+// isV5 reports whether the client speaks MQTT 5
+func (c *Client) isV5() bool {
+	return c.config.ProtocolVersion == "5"
+}
+
+// connectV5 connects with MQTT 5. autopaho keeps retrying in the
+// background, so like the 3.1.1 client an unreachable broker is not an
+// error. Called with c.mu held.
+func (c *Client) connectV5(broker string, tlsCfg *tls.Config) error {
+	serverURL, err := url.Parse(broker)
+	if err != nil {
+		return fmt.Errorf("invalid MQTT broker URL %s: %w", broker, err)
+	}
+
+	cfg := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{serverURL},
+		TlsCfg:                        tlsCfg,
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: true,
+		ConnectRetryDelay:             5 * time.Second,
+		ConnectTimeout:                10 * time.Second,
+		ConnectUsername:               c.config.User,
+		ConnectPassword:               []byte(c.config.Password),
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, connack *paho5.Connack) {
+			var brokerMax uint16
+			if connack.Properties != nil && connack.Properties.TopicAliasMaximum != nil {
+				brokerMax = *connack.Properties.TopicAliasMaximum
+			}
+			c.aliases.reset(aliasLimit(c.config.TopicAliasMaximum, brokerMax))
+
+			c.mu.Lock()
+			c.connected = true
+			c.session++
+			c.mu.Unlock()
+			fmt.Printf("[MQTT Client] Connected successfully to %s (MQTT 5, topic aliases: %d)\n", broker, c.aliases.limit())
+			// restartHeartbeat waits for a running heartbeat, which takes c.mu
+			c.restartHeartbeat()
+			c.subscribeV5(cm)
+		},
+		OnConnectError: func(err error) {
+			fmt.Printf("[MQTT Client] Connection attempt failed: %v\n", err)
+		},
+		ClientConfig: paho5.ClientConfig{
+			ClientID: c.config.ClientID,
+			OnPublishReceived: []func(paho5.PublishReceived) (bool, error){
+				c.receiveV5,
+			},
+			OnClientError: func(err error) {
+				c.connectionLostV5(err)
+			},
+			OnServerDisconnect: func(d *paho5.Disconnect) {
+				c.connectionLostV5(fmt.Errorf("server disconnected (reason %d)", d.ReasonCode))
+			},
+		},
+	}
+	if c.statusSource != nil {
+		cfg.WillMessage = &paho5.WillMessage{Topic: c.statusTopic(), QoS: 1, Retain: true, Payload: c.statusPayload(statusOffline)}
+		cfg.WillProperties = &paho5.WillProperties{ContentType: contentTypeJSON}
+	}
+	if c.config.User == "" {
+		cfg.ResetUsernamePassword()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cm, err := autopaho.NewConnection(ctx, cfg)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("failed to connect to MQTT broker %s: %w", broker, err)
+	}
+	c.v5 = cm
+	c.cancelV5 = cancel
+
+	waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer waitCancel()
+	if err := cm.AwaitConnection(waitCtx); err != nil {
+		fmt.Printf("[MQTT Client] Still connecting to %s, retrying in background\n", broker)
+		return nil
+	}
+	fmt.Printf("[MQTT Client] Connection established to %s (MQTT 5)\n", broker)
+	return nil
+}
+
+// connectionLostV5 marks the MQTT 5 connection as down. Aliases are
+// dropped at once since the broker forgets them with the connection.
+func (c *Client) connectionLostV5(err error) {
+	c.aliases.reset(0)
+	c.mu.Lock()
+	c.connected = false
+	c.mu.Unlock()
+	fmt.Printf("[MQTT Client] Connection lost: %v\n", err)
+}
+
+// disconnectV5 closes the MQTT 5 connection
+func (c *Client) disconnectV5() {
+	c.mu.Lock()
+	cm, stop := c.v5, c.cancelV5
+	c.v5, c.cancelV5 = nil, nil
+	c.mu.Unlock()
+	if cm == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := cm.Disconnect(ctx); err != nil {
+		log.Printf("[MQTT Client] Disconnect: %v", err)
+	}
+	stop()
+}
+
+// publishV5 sends msg with its MQTT 5 properties, using a topic alias
+// when one is available. QoS 1 and 2 wait up to timeout for the
+// acknowledgement, and at most controlTimeout once abort is closed.
+func (c *Client) publishV5(msg Message, timeout time.Duration, abort <-chan struct{}) error {
+	c.mu.RLock()
+	cm := c.v5
+	c.mu.RUnlock()
+	if cm == nil {
+		return fmt.Errorf("MQTT client not connected")
+	}
+
+	pub := &paho5.Publish{
+		Topic:      msg.Topic,
+		QoS:        msg.QoS,
+		Retain:     msg.Retained,
+		Payload:    msg.Payload,
+		Properties: &paho5.PublishProperties{},
+	}
+	if p := msg.Properties; p != nil {
+		pub.Properties.ContentType = p.ContentType
+		pub.Properties.ResponseTopic = p.ResponseTopic
+		pub.Properties.CorrelationData = p.CorrelationData
+		if p.MessageExpiry > 0 {
+			expiry := p.MessageExpiry
+			pub.Properties.MessageExpiry = &expiry
+		}
+		for _, up := range p.User {
+			pub.Properties.User.Add(up.Key, up.Value)
+		}
+	}
+
+	alias, known := c.aliases.lookup(msg.Topic)
+	if alias != 0 {
+		pub.Properties.TopicAlias = &alias
+		if known {
+			pub.Topic = ""
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-abort:
+			select {
+			case <-time.After(controlTimeout):
+				cancel()
+			case <-ctx.Done():
+			}
+		case <-ctx.Done():
+		}
+	}()
+	if _, err := cm.Publish(ctx, pub); err != nil {
+		if ctx.Err() != nil {
+			log.Printf("[MQTT] Timeout publishing to %s (payload size: %d bytes)", msg.Topic, len(msg.Payload))
+			return fmt.Errorf("publish timeout after %s for topic %s", timeout, msg.Topic)
+		}
+		return fmt.Errorf("failed to publish to %s: %w", msg.Topic, err)
+	}
+	if alias != 0 && !known {
+		c.aliases.established(msg.Topic, alias)
+	}
+	return nil
+}
+
+// aliasLimit is the number of topic aliases to use: the configured
+// maximum, capped by what the broker accepts
+func aliasLimit(configured int, broker uint16) uint16 {
+	if configured <= 0 {
+		return 0
+	}
+	if configured < int(broker) {
+		return uint16(configured)
+	}
+	return broker
+}
+
+// topicAliases assigns MQTT 5 topic aliases, so repeated publishes to a
+// per-center topic carry a two-byte alias instead of the topic name.
+// Aliases are only valid for one connection.
+type topicAliases struct {
+	mu    sync.Mutex
+	max   uint16
+	ids   map[string]uint16
+	known map[string]bool // Mapping already sent to the broker
+}
+
+// reset forgets every alias and allows up to max new ones
+func (a *topicAliases) reset(max uint16) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.max = max
+	a.ids = make(map[string]uint16)
+	a.known = make(map[string]bool)
+}
+
+// limit returns the number of aliases allowed on this connection
+func (a *topicAliases) limit() uint16 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.max
+}
+
+// lookup returns the alias of topic (0 when aliases are used up or
+// disabled) and whether the broker already knows it. Until then the full
+// topic must be sent along with the alias.
+func (a *topicAliases) lookup(topic string) (uint16, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if id, ok := a.ids[topic]; ok {
+		return id, a.known[topic]
+	}
+	if len(a.ids) >= int(a.max) {
+		return 0, false
+	}
+	id := uint16(len(a.ids) + 1)
+	a.ids[topic] = id
+	return id, false
+}
+
+// established records that the broker received the topic for alias.
+// A reset in between (reconnect) makes the alias stale, so it is ignored.
+func (a *topicAliases) established(topic string, alias uint16) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.ids[topic] == alias {
+		a.known[topic] = true
+	}
+}
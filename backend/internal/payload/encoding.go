@@ -0,0 +1,239 @@
+package payload
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Payload encodings a profile can select
+const (
+	EncodingJSON     = "json"
+	EncodingGzip     = "gzip" // gzip-compressed JSON
+	EncodingZstd     = "zstd" // zstd-compressed JSON
+	EncodingCBOR     = "cbor"
+	EncodingMsgpack  = "msgpack"
+	EncodingProtobuf = "protobuf" // omnipoll.v1.FeedingEvent, see proto/omnipoll/v1/feeding_event.proto
+)
+
+// Protobuf message types, advertised in the content type
+const (
+	protoEvent = "omnipoll.v1.FeedingEvent"
+	protoBatch = "omnipoll.v1.FeedingEventBatch"
+)
+
+// Codec serializes records in one encoding. Records are marshaled one
+// by one, then framed into a message alone or as an array (batch).
+type Codec struct {
+	name      string
+	mediaType string // Content type of one record
+	batchType string // Content type of an array of records
+	marshal   func(r Record) ([]byte, error)
+	array     func(items [][]byte) []byte
+	compress  func(data []byte) []byte // nil when uncompressed
+}
+
+// Encodings lists the payload encodings
+func Encodings() []string {
+	return []string{EncodingJSON, EncodingGzip, EncodingZstd, EncodingCBOR, EncodingMsgpack, EncodingProtobuf}
+}
+
+// NewCodec returns the codec for an encoding; empty means JSON
+func NewCodec(encoding string) (*Codec, error) {
+	jsonCodec := func(name, mediaType string, compress func([]byte) []byte) *Codec {
+		return &Codec{
+			name:      name,
+			mediaType: mediaType,
+			batchType: mediaType,
+			marshal:   func(r Record) ([]byte, error) { return json.Marshal(r) },
+			array:     jsonArray,
+			compress:  compress,
+		}
+	}
+
+	switch encoding {
+	case "", EncodingJSON:
+		return jsonCodec(EncodingJSON, "application/json", nil), nil
+	case EncodingGzip:
+		return jsonCodec(EncodingGzip, "application/json+gzip", gzipCompress), nil
+	case EncodingZstd:
+		return jsonCodec(EncodingZstd, "application/json+zstd", zstdCompress), nil
+	case EncodingCBOR:
+		return &Codec{
+			name:      EncodingCBOR,
+			mediaType: "application/cbor",
+			batchType: "application/cbor",
+			marshal:   func(r Record) ([]byte, error) { return cbor.Marshal(r) },
+			array:     cborArrayOf,
+		}, nil
+	case EncodingMsgpack:
+		return &Codec{
+			name:      EncodingMsgpack,
+			mediaType: "application/msgpack",
+			batchType: "application/msgpack",
+			marshal:   func(r Record) ([]byte, error) { return msgpack.Marshal(r) },
+			array:     msgpackArray,
+		}, nil
+	case EncodingProtobuf:
+		return &Codec{
+			name:      EncodingProtobuf,
+			mediaType: "application/x-protobuf; messageType=" + protoEvent,
+			batchType: "application/x-protobuf; messageType=" + protoBatch,
+			marshal:   marshalProto,
+			array:     protoArray,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown encoding %q (expected one of %s)", encoding, strings.Join(Encodings(), ", "))
+}
+
+// Name returns the encoding name, e.g. "cbor"
+func (c *Codec) Name() string {
+	return c.name
+}
+
+// ContentType returns the MIME type of a single or batch message
+func (c *Codec) ContentType(batch bool) string {
+	if batch {
+		return c.batchType
+	}
+	return c.mediaType
+}
+
+// Marshal encodes one record, uncompressed
+func (c *Codec) Marshal(r Record) ([]byte, error) {
+	return c.marshal(r)
+}
+
+// Message frames marshaled records into a payload: the record itself, or
+// an array of them when batch is set, compressed if the encoding is
+func (c *Codec) Message(items [][]byte, batch bool) []byte {
+	data := items[0]
+	if batch {
+		data = c.array(items)
+	}
+	if c.compress != nil {
+		data = c.compress(data)
+	}
+	return data
+}
+
+func jsonArray(items [][]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, item := range items {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(item)
+	}
+	buf.WriteByte(']')
+	return buf.Bytes()
+}
+
+func cborArrayOf(items [][]byte) []byte {
+	return append(cborHead(cborArray, len(items)), bytes.Join(items, nil)...)
+}
+
+func msgpackArray(items [][]byte) []byte {
+	var buf bytes.Buffer
+	_ = msgpack.NewEncoder(&buf).EncodeArrayLen(len(items))
+	for _, item := range items {
+		buf.Write(item)
+	}
+	return buf.Bytes()
+}
+
+func gzipCompress(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	// Writing to a bytes.Buffer does not fail
+	_, _ = zw.Write(data)
+	_ = zw.Close()
+	return buf.Bytes()
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+)
+
+func zstdCompress(data []byte) []byte {
+	zstdOnce.Do(func() {
+		// Without options NewWriter cannot fail
+		zstdEncoder, _ = zstd.NewWriter(nil)
+	})
+	return zstdEncoder.EncodeAll(data, nil)
+}
+
+// marshalProto encodes a record of event fields as a FeedingEvent. Field
+// numbers follow the NormalizedEvent field order; zero values are left
+// out, as proto3 does.
+func marshalProto(r Record) ([]byte, error) {
+	var b []byte
+	for _, m := range r {
+		idx, ok := eventFields[m.Key]
+		if !ok {
+			return nil, fmt.Errorf("%s is not a %s field", m.Key, protoEvent)
+		}
+		num := protowire.Number(idx + 1)
+		switch v := m.Value.(type) {
+		case string:
+			if v != "" {
+				b = protowire.AppendTag(b, num, protowire.BytesType)
+				b = protowire.AppendString(b, v)
+			}
+		case int:
+			if v != 0 {
+				b = protowire.AppendTag(b, num, protowire.VarintType)
+				b = protowire.AppendVarint(b, uint64(int64(v)))
+			}
+		case float64:
+			if v != 0 {
+				b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+				b = protowire.AppendFixed64(b, math.Float64bits(v))
+			}
+		case time.Time:
+			if !v.IsZero() {
+				b = protowire.AppendTag(b, num, protowire.BytesType)
+				b = protowire.AppendBytes(b, protoTimestamp(v))
+			}
+		default:
+			return nil, fmt.Errorf("failed to encode %s: unsupported type %T", m.Key, m.Value)
+		}
+	}
+	return b, nil
+}
+
+// protoTimestamp encodes a google.protobuf.Timestamp
+func protoTimestamp(t time.Time) []byte {
+	var b []byte
+	if s := t.Unix(); s != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(s))
+	}
+	if n := t.Nanosecond(); n != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(n))
+	}
+	return b
+}
+
+// protoArray encodes a FeedingEventBatch of marshaled FeedingEvents
+func protoArray(items [][]byte) []byte {
+	var b []byte
+	for _, item := range items {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, item)
+	}
+	return b
+}
@@ -0,0 +1,162 @@
+package payload
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// node is a parsed arithmetic expression
+type node interface {
+	eval(field func(name string) float64) float64
+}
+
+type (
+	literal  float64
+	variable string
+	negate   struct{ x node }
+	binary   struct {
+		op   byte
+		l, r node
+	}
+)
+
+func (n literal) eval(func(string) float64) float64 { return float64(n) }
+
+func (n variable) eval(field func(string) float64) float64 { return field(string(n)) }
+
+func (n negate) eval(field func(string) float64) float64 { return -n.x.eval(field) }
+
+func (n binary) eval(field func(string) float64) float64 {
+	l, r := n.l.eval(field), n.r.eval(field)
+	switch n.op {
+	case '+':
+		return l + r
+	case '-':
+		return l - r
+	case '*':
+		return l * r
+	default:
+		return l / r
+	}
+}
+
+// parseExpr parses + - * / and parentheses over numbers and numeric
+// event fields, e.g. "amountGrams / 1000 / fishCount"
+func parseExpr(s string) (node, error) {
+	p := &exprParser{src: s}
+	n, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.src[p.pos], p.pos)
+	}
+	return n, nil
+}
+
+type exprParser struct {
+	src string
+	pos int
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// peek returns the next operator character, or 0
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+func (p *exprParser) sum() (node, error) {
+	l, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		r, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		l = binary{op: op, l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) product() (node, error) {
+	l, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l = binary{op: op, l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) unary() (node, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return negate{x}, nil
+	case '(':
+		p.pos++
+		x, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) at position %d", p.pos)
+		}
+		p.pos++
+		return x, nil
+	case 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+
+	start := p.pos
+	for p.pos < len(p.src) && (isIdentChar(rune(p.src[p.pos])) || p.src[p.pos] == '.') {
+		p.pos++
+	}
+	token := p.src[start:p.pos]
+	if token == "" {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.src[start], start)
+	}
+	if unicode.IsDigit(rune(token[0])) || token[0] == '.' {
+		f, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", token)
+		}
+		return literal(f), nil
+	}
+	if _, ok := eventFields[token]; !ok || strings.Contains(token, ".") {
+		return nil, fmt.Errorf("unknown field %q", token)
+	}
+	if !isNumeric(token) {
+		return nil, fmt.Errorf("field %q is not numeric", token)
+	}
+	return variable(token), nil
+}
+
+func isIdentChar(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,254 @@
+// Package payload shapes events into MQTT payloads according to
+// configurable profiles: field selection, renames, unit conversions,
+// computed fields and the wire encoding.
+package payload
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/omnipoll/backend/internal/events"
+	"github.com/omnipoll/backend/internal/topic"
+)
+
+// Legacy is the built-in profile: the original MQTTMessage layout
+const Legacy = "legacy"
+
+// Profile is a payload shape, published to its own topic
+type Profile struct {
+	Name          string  `json:"name" yaml:"name"`
+	TopicTemplate string  `json:"topicTemplate" yaml:"topicTemplate"` // Empty uses mqtt.topicTemplate
+	Fields        []Field `json:"fields" yaml:"fields"`
+	Encoding      string  `json:"encoding" yaml:"encoding"` // Empty is json, see Encodings
+}
+
+// Field is one member of the payload, copied from an event field
+// (Source) or computed from numeric fields (Expr)
+type Field struct {
+	Name      string `json:"name" yaml:"name"`
+	Source    string `json:"source,omitempty" yaml:"source,omitempty"`       // Event field, e.g. "amountGrams"
+	Expr      string `json:"expr,omitempty" yaml:"expr,omitempty"`           // e.g. "amountGrams / fishCount"
+	Convert   string `json:"convert,omitempty" yaml:"convert,omitempty"`     // Unit conversion, e.g. "g_to_kg"
+	Normalize string `json:"normalize,omitempty" yaml:"normalize,omitempty"` // Text function, e.g. "digits"
+}
+
+// IsLegacy reports whether p is the built-in legacy profile
+func (p Profile) IsLegacy() bool {
+	return p.Name == Legacy
+}
+
+// conversions are the unit conversion factors
+var conversions = map[string]float64{
+	"g_to_kg": 1e-3,
+	"g_to_t":  1e-6,
+	"kg_to_g": 1e3,
+	"kg_to_t": 1e-3,
+	"t_to_kg": 1e3,
+}
+
+// eventFields indexes NormalizedEvent fields by JSON name
+var eventFields = func() map[string]int {
+	t := reflect.TypeOf(events.NormalizedEvent{})
+	idx := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		idx[name] = i
+	}
+	return idx
+}()
+
+// SourceNames lists the event fields a profile can use
+func SourceNames() []string {
+	names := make([]string, 0, len(eventFields))
+	for name := range eventFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isNumeric reports whether the event field called name is a number
+func isNumeric(name string) bool {
+	switch reflect.TypeOf(events.NormalizedEvent{}).Field(eventFields[name]).Type.Kind() {
+	case reflect.Int, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// Validate checks the profile without compiling it for use
+func (p Profile) Validate() error {
+	if strings.TrimSpace(p.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	if p.TopicTemplate != "" {
+		if _, err := topic.Parse(p.TopicTemplate); err != nil {
+			return fmt.Errorf("topicTemplate: %v", err)
+		}
+	}
+	codec, err := NewCodec(p.Encoding)
+	if err != nil {
+		return err
+	}
+	if codec.Name() == EncodingProtobuf {
+		// The .proto schema is the whole event
+		if p.IsLegacy() {
+			return fmt.Errorf("encoding: the %q layout has no protobuf schema", Legacy)
+		}
+		if len(p.Fields) > 0 {
+			return fmt.Errorf("fields: protobuf publishes the whole event as %s and cannot define fields", protoEvent)
+		}
+		return nil
+	}
+	if p.IsLegacy() {
+		if len(p.Fields) > 0 {
+			return fmt.Errorf("the %q profile is built in and cannot define fields", Legacy)
+		}
+		return nil
+	}
+	_, err = Compile(p)
+	return err
+}
+
+// Encoder renders events with a compiled profile
+type Encoder struct {
+	fields []compiledField
+}
+
+type compiledField struct {
+	name  string
+	value func(e reflect.Value) interface{}
+}
+
+// Compile prepares a custom profile for encoding
+func Compile(p Profile) (*Encoder, error) {
+	if p.IsLegacy() {
+		return nil, fmt.Errorf("the %q profile is built in", Legacy)
+	}
+	if len(p.Fields) == 0 {
+		return nil, fmt.Errorf("fields: at least one field is required")
+	}
+
+	enc := &Encoder{}
+	seen := make(map[string]bool)
+	for i, f := range p.Fields {
+		cf, err := compileField(f)
+		if err != nil {
+			return nil, fmt.Errorf("fields.%d: %v", i, err)
+		}
+		if seen[f.Name] {
+			return nil, fmt.Errorf("fields.%d: duplicate name %q", i, f.Name)
+		}
+		seen[f.Name] = true
+		enc.fields = append(enc.fields, cf)
+	}
+	return enc, nil
+}
+
+func compileField(f Field) (compiledField, error) {
+	cf := compiledField{name: f.Name}
+	if strings.TrimSpace(f.Name) == "" {
+		return cf, fmt.Errorf("name is required")
+	}
+	if (f.Source == "") == (f.Expr == "") {
+		return cf, fmt.Errorf("exactly one of source or expr is required")
+	}
+
+	factor := 1.0
+	if f.Convert != "" {
+		var ok bool
+		if factor, ok = conversions[f.Convert]; !ok {
+			return cf, fmt.Errorf("unknown conversion %q (expected one of %s)", f.Convert, strings.Join(sortedKeys(conversions), ", "))
+		}
+	}
+
+	if f.Expr != "" {
+		if f.Normalize != "" {
+			return cf, fmt.Errorf("normalize only applies to text fields")
+		}
+		x, err := parseExpr(f.Expr)
+		if err != nil {
+			return cf, fmt.Errorf("expr: %v", err)
+		}
+		cf.value = func(e reflect.Value) interface{} {
+			return finite(x.eval(func(name string) float64 { return number(e.Field(eventFields[name])) }) * factor)
+		}
+		return cf, nil
+	}
+
+	idx, ok := eventFields[f.Source]
+	if !ok {
+		return cf, fmt.Errorf("unknown source %q (expected one of %s)", f.Source, strings.Join(SourceNames(), ", "))
+	}
+	if isNumeric(f.Source) {
+		if f.Normalize != "" {
+			return cf, fmt.Errorf("normalize only applies to text fields, %q is a number", f.Source)
+		}
+		if f.Convert == "" {
+			cf.value = func(e reflect.Value) interface{} { return e.Field(idx).Interface() }
+		} else {
+			cf.value = func(e reflect.Value) interface{} { return finite(number(e.Field(idx)) * factor) }
+		}
+		return cf, nil
+	}
+
+	if f.Convert != "" {
+		return cf, fmt.Errorf("convert only applies to numeric fields, %q is text", f.Source)
+	}
+	normalize := func(s string) string { return s }
+	if f.Normalize != "" {
+		if normalize, ok = topic.Func(f.Normalize); !ok {
+			return cf, fmt.Errorf("unknown normalize function %q (expected one of %s)", f.Normalize, strings.Join(topic.FuncNames(), ", "))
+		}
+	}
+	cf.value = func(e reflect.Value) interface{} {
+		switch v := e.Field(idx).Interface().(type) {
+		case time.Time:
+			return normalize(v.Format(time.RFC3339))
+		case string:
+			return normalize(v)
+		default:
+			return v
+		}
+	}
+	return cf, nil
+}
+
+// Record shapes the event with the profile's fields, in order
+func (enc *Encoder) Record(event events.NormalizedEvent) Record {
+	e := reflect.ValueOf(event)
+	r := make(Record, len(enc.fields))
+	for i, f := range enc.fields {
+		r[i] = Member{Key: f.name, Value: f.value(e)}
+	}
+	return r
+}
+
+// number returns a numeric event field as float64
+func number(v reflect.Value) float64 {
+	if v.Kind() == reflect.Int {
+		return float64(v.Int())
+	}
+	return v.Float()
+}
+
+// finite maps NaN and infinities (e.g. division by zero) to null
+func finite(f float64) interface{} {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil
+	}
+	return f
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,119 @@
+package payload
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/omnipoll/backend/internal/events"
+)
+
+// Record is a payload object whose members keep their order in every
+// encoding
+type Record []Member
+
+// Member is one key and value of a Record
+type Member struct {
+	Key   string
+	Value interface{}
+}
+
+// RecordOf turns a struct into a Record named and ordered by its json tags
+func RecordOf(v interface{}) Record {
+	rv := reflect.ValueOf(v)
+	t := rv.Type()
+	r := make(Record, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = t.Field(i).Name
+		}
+		r = append(r, Member{Key: name, Value: rv.Field(i).Interface()})
+	}
+	return r
+}
+
+// EventRecord is the whole event in NormalizedEvent field order, the
+// shape of the protobuf FeedingEvent message
+func EventRecord(event events.NormalizedEvent) Record {
+	return RecordOf(event)
+}
+
+// MarshalJSON writes the members as a JSON object, in order
+func (r Record) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, m := range r {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(m.Key)
+		value, err := json.Marshal(m.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s: %w", m.Key, err)
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// MarshalCBOR writes the members as a CBOR map, in order
+func (r Record) MarshalCBOR() ([]byte, error) {
+	buf := cborHead(cborMap, len(r))
+	for _, m := range r {
+		key, _ := cbor.Marshal(m.Key)
+		value, err := cbor.Marshal(m.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s: %w", m.Key, err)
+		}
+		buf = append(append(buf, key...), value...)
+	}
+	return buf, nil
+}
+
+// EncodeMsgpack writes the members as a MessagePack map, in order
+func (r Record) EncodeMsgpack(enc *msgpack.Encoder) error {
+	if err := enc.EncodeMapLen(len(r)); err != nil {
+		return err
+	}
+	for _, m := range r {
+		if err := enc.EncodeString(m.Key); err != nil {
+			return err
+		}
+		if err := enc.Encode(m.Value); err != nil {
+			return fmt.Errorf("failed to encode %s: %w", m.Key, err)
+		}
+	}
+	return nil
+}
+
+// CBOR major types
+const (
+	cborArray byte = 4 << 5
+	cborMap   byte = 5 << 5
+)
+
+// cborHead encodes the header of an array or map of n items
+func cborHead(major byte, n int) []byte {
+	switch {
+	case n < 24:
+		return []byte{major | byte(n)}
+	case n <= 0xff:
+		return []byte{major | 24, byte(n)}
+	case n <= 0xffff:
+		return []byte{major | 25, byte(n >> 8), byte(n)}
+	default:
+		return []byte{major | 26, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+}
@@ -12,13 +12,15 @@ import (
 	"github.com/omnipoll/backend/internal/events"
 	"github.com/omnipoll/backend/internal/mongo"
 	"github.com/omnipoll/backend/internal/mqtt"
+	"github.com/omnipoll/backend/internal/telemetry"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // Poller handles incremental data extraction with watermark management
 type Poller struct {
 	config     config.PollingConfig
 	akvaClient *akva.Client
-	mqttPub    *mqtt.Publisher
+	mqttOut    *mqtt.Brokers
 	mongoRepo  *mongo.Repository
 	watermark  *WatermarkManager
 	stats      *Stats
@@ -44,14 +46,14 @@ type Stats struct {
 func NewPoller(
 	cfg config.PollingConfig,
 	akvaClient *akva.Client,
-	mqttPub *mqtt.Publisher,
+	mqttOut *mqtt.Brokers,
 	mongoRepo *mongo.Repository,
 	watermark *WatermarkManager,
 ) *Poller {
 	return &Poller{
 		config:     cfg,
 		akvaClient: akvaClient,
-		mqttPub:    mqttPub,
+		mqttOut:    mqttOut,
 		mongoRepo:  mongoRepo,
 		watermark:  watermark,
 		stats: &Stats{
@@ -61,7 +63,13 @@ func NewPoller(
 }
 
 // Poll executes one polling cycle
-func (p *Poller) Poll(ctx context.Context) error {
+func (p *Poller) Poll(ctx context.Context) (err error) {
+	ctx, span := telemetry.Tracer().Start(ctx, "poll.cycle")
+	defer func() {
+		telemetry.RecordError(span, err)
+		span.End()
+	}()
+
 	log.Printf("[Poller] Starting poll cycle at %s", time.Now().Format(time.RFC3339))
 	
 	// Update connection status before attempting operations
@@ -71,20 +79,40 @@ func (p *Poller) Poll(ctx context.Context) error {
 	if p.akvaClient == nil {
 		return fmt.Errorf("not connected to SQL Server (Akva)")
 	}
-	if p.mqttPub == nil {
+	if p.mqttOut == nil {
 		return fmt.Errorf("not connected to MQTT")
 	}
 	if p.mongoRepo == nil {
 		return fmt.Errorf("not connected to MongoDB")
 	}
 
+	// A broker that falls behind holds back the watermark: fetch only
+	// what every outbox can take, so no event is dropped
+	batchSize := p.config.BatchSize
+	if room := p.mqttOut.Room(); room < batchSize {
+		if room == 0 {
+			log.Printf("[Poller] MQTT outbox full, skipping this cycle until it drains")
+			return nil
+		}
+		log.Printf("[Poller] MQTT outbox nearly full, fetching %d records", room)
+		batchSize = room
+	}
+
 	// Get current watermark
 	wm := p.watermark.Get()
 	log.Printf("[Poller] Current watermark - LastFechaHora: %s, IDs count: %d", wm.LastFechaHora.Format(time.RFC3339), len(wm.IDsAtLastFechaHora))
 
 	// Fetch new records from Akva
-	log.Printf("[Poller] Fetching records from SQL Server (batch size: %d)", p.config.BatchSize)
-	records, err := p.akvaClient.FetchNewRecords(ctx, wm.LastFechaHora, wm.IDsAtLastFechaHora, p.config.BatchSize)
+	log.Printf("[Poller] Fetching records from SQL Server (batch size: %d)", batchSize)
+	fetchCtx, fetchSpan := telemetry.Tracer().Start(ctx, "akva.FetchNewRecords")
+	fetchSpan.SetAttributes(
+		attribute.String("watermark.last_fecha_hora", wm.LastFechaHora.Format(time.RFC3339)),
+		attribute.Int("batch.size", batchSize),
+	)
+	records, err := p.akvaClient.FetchNewRecords(fetchCtx, wm.LastFechaHora, wm.IDsAtLastFechaHora, batchSize)
+	fetchSpan.SetAttributes(attribute.Int("records.count", len(records)))
+	telemetry.RecordError(fetchSpan, err)
+	fetchSpan.End()
 	if err != nil {
 		log.Printf("[Poller] ERROR fetching from SQL Server: %v", err)
 		p.statsMu.Lock()
@@ -100,18 +128,27 @@ func (p *Poller) Poll(ctx context.Context) error {
 
 	log.Printf("[Poller] ✓ Fetched %d new records from Akva", len(records))
 
+	span.SetAttributes(attribute.Int("records.count", len(records)))
+
 	// Convert to normalized events
+	_, mapSpan := telemetry.Tracer().Start(ctx, "akva.ToNormalizedEvents")
 	normalizedEvents := akva.ToNormalizedEvents(records)
+	mapSpan.End()
 
-	// For MQTT: Publish all newly fetched records (based on watermark, they're guaranteed new)
-	// MongoDB filtering is for deduplication only, not for MQTT publishing
+	// For MQTT: Queue all newly fetched records (based on watermark, they're guaranteed new)
+	// for every broker output. MongoDB filtering is for deduplication only, not for MQTT publishing
 	if len(normalizedEvents) > 0 {
-		log.Printf("[Poller] Publishing %d new records to MQTT (from SQL watermark)", len(normalizedEvents))
-		if err := p.mqttPub.PublishBatch(normalizedEvents); err != nil {
-			log.Printf("[Poller] WARNING: MQTT publish error: %v", err)
+		log.Printf("[Poller] Queuing %d new records for MQTT (from SQL watermark)", len(normalizedEvents))
+		_, pubSpan := telemetry.Tracer().Start(ctx, "mqtt.Enqueue")
+		pubSpan.SetAttributes(attribute.Int("events.count", len(normalizedEvents)))
+		pubErr := p.mqttOut.Enqueue(normalizedEvents)
+		telemetry.RecordError(pubSpan, pubErr)
+		pubSpan.End()
+		if err := pubErr; err != nil {
+			log.Printf("[Poller] WARNING: MQTT outbox error: %v", err)
 			// Don't return error - continue with MongoDB persistence
 		} else {
-			log.Printf("[Poller] ✓ Published %d records to MQTT", len(normalizedEvents))
+			log.Printf("[Poller] ✓ Queued %d records for MQTT", len(normalizedEvents))
 		}
 	} else {
 		log.Printf("[Poller] No new records to publish")
@@ -120,7 +157,12 @@ func (p *Poller) Poll(ctx context.Context) error {
 	// Persist to MongoDB (skip if not connected)
 	if p.mongoRepo != nil {
 		log.Printf("[Poller] Persisting %d events to MongoDB...", len(normalizedEvents))
-		if err := p.mongoRepo.InsertBatch(ctx, normalizedEvents); err != nil {
+		insertCtx, insertSpan := telemetry.Tracer().Start(ctx, "mongo.InsertBatch")
+		insertSpan.SetAttributes(attribute.Int("events.count", len(normalizedEvents)))
+		insertErr := p.mongoRepo.InsertBatch(insertCtx, normalizedEvents)
+		telemetry.RecordError(insertSpan, insertErr)
+		insertSpan.End()
+		if err := insertErr; err != nil {
 			log.Printf("[Poller] WARNING: MongoDB insert error (may be duplicates): %v", err)
 			// Continue anyway - duplicates are expected for idempotency
 		}
@@ -129,6 +171,17 @@ func (p *Poller) Poll(ctx context.Context) error {
 		log.Printf("[Poller] WARNING: MongoDB not available, skipping persistence")
 	}
 
+	// Retained latest state per jaula (mqtt.stateTopic)
+	if p.mqttOut.StateEnabled() {
+		stateCtx, stateSpan := telemetry.Tracer().Start(ctx, "mqtt.PublishStates")
+		stateErr := p.publishStates(stateCtx, normalizedEvents)
+		telemetry.RecordError(stateSpan, stateErr)
+		stateSpan.End()
+		if stateErr != nil {
+			log.Printf("[Poller] WARNING: MQTT state update error: %v", stateErr)
+		}
+	}
+
 	// Update watermark
 	// Find the latest timestamp and collect IDs at that timestamp
 	var latestTime time.Time
@@ -198,10 +251,10 @@ func (p *Poller) RefreshStats(ctx context.Context) {
 		p.stats.MongoConnected = p.mongoRepo.IsConnected()
 	}
 
-	if p.mqttPub == nil {
+	if p.mqttOut == nil {
 		p.stats.MQTTConnected = false
 	} else {
-		p.stats.MQTTConnected = p.mqttPub.IsConnected()
+		p.stats.MQTTConnected = p.mqttOut.IsConnected()
 	}
 
 	if p.akvaClient == nil {
@@ -216,8 +269,8 @@ func (p *Poller) UpdateConnectionStats() {
 	p.statsMu.Lock()
 	defer p.statsMu.Unlock()
 
-	if p.mqttPub != nil {
-		p.stats.MQTTConnected = p.mqttPub.IsConnected()
+	if p.mqttOut != nil {
+		p.stats.MQTTConnected = p.mqttOut.IsConnected()
 	} else {
 		p.stats.MQTTConnected = false
 	}
@@ -0,0 +1,57 @@
+package poller
+
+import (
+	"context"
+	"log"
+
+	"github.com/omnipoll/backend/internal/events"
+	"github.com/omnipoll/backend/internal/mongo"
+	"github.com/omnipoll/backend/internal/mqtt"
+)
+
+// publishStates updates the retained latest-state topic of every jaula
+// in the batch. Day totals come from MongoDB, so they include earlier
+// cycles and survive restarts.
+func (p *Poller) publishStates(ctx context.Context, evts []events.NormalizedEvent) error {
+	latest := latestPerJaula(evts)
+	keys := make([]mongo.JaulaDay, len(latest))
+	for i, e := range latest {
+		keys[i] = mongo.JaulaDay{Centro: e.Name, UnitName: e.UnitName, Dia: e.Dia}
+	}
+	totals, err := p.mongoRepo.DayTotals(ctx, keys)
+	if err != nil {
+		return err
+	}
+
+	states := make([]mqtt.JaulaState, len(latest))
+	for i, e := range latest {
+		states[i] = mqtt.NewJaulaState(e, totals[keys[i]])
+	}
+	if err := p.mqttOut.PublishStates(states); err != nil {
+		return err
+	}
+	log.Printf("[Poller] ✓ Updated state of %d jaulas", len(states))
+	return nil
+}
+
+// latestPerJaula returns the most recent event of each centro/jaula, in
+// order of first appearance
+func latestPerJaula(evts []events.NormalizedEvent) []events.NormalizedEvent {
+	type key struct{ centro, jaula string }
+	index := make(map[key]int)
+	var latest []events.NormalizedEvent
+	for _, e := range evts {
+		k := key{e.Name, e.UnitName}
+		i, ok := index[k]
+		if !ok {
+			index[k] = len(latest)
+			latest = append(latest, e)
+			continue
+		}
+		// fechaHora is RFC3339 UTC, so it sorts as text
+		if e.FechaHora >= latest[i].FechaHora {
+			latest[i] = e
+		}
+	}
+	return latest
+}
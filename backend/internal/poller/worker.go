@@ -14,22 +14,48 @@ import (
 	"github.com/omnipoll/backend/internal/mqtt"
 )
 
+// maxReplayEvents bounds the events a single replay may publish
+const maxReplayEvents = 10000
+
 // Worker manages the polling goroutine lifecycle
 type Worker struct {
 	mu            sync.RWMutex
 	running       bool
 	stopChan      chan struct{}
 	configManager *config.Manager
-	poller        *Poller
 	watermark     *WatermarkManager
+	clientsMu     sync.RWMutex // Guards the poller, clients and repositories set by Initialize
+	poller        *Poller
 	akvaClient    *akva.Client
 	mqttClient    *mqtt.Client
-	mqttPub       *mqtt.Publisher
+	mqttOut       *mqtt.Brokers // Primary broker first
 	mongoClient   *mongo.Client
 	mongoRepo     *mongo.Repository
+	auditRepo     *mongo.AuditRepository
 	logsMu        sync.Mutex
 	logs          []events.LogEntry
 	maxLogs       int
+	cycleMu       sync.Mutex
+	lastCycle     *CycleResult
+	pollMu        sync.Mutex // Serializes poll cycles and replays
+	commandsMu    sync.RWMutex
+	commands      mqtt.CommandHandler
+}
+
+// CycleResult is the outcome of a poll cycle
+type CycleResult struct {
+	At         time.Time `json:"at"`
+	DurationMS int64     `json:"durationMs"`
+	Events     int64     `json:"events"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// HeartbeatReport is the worker state published with each MQTT heartbeat
+type HeartbeatReport struct {
+	Running     bool            `json:"running"`
+	Watermark   time.Time       `json:"watermark"` // LastFechaHora
+	LastCycle   *CycleResult    `json:"lastCycle"` // nil before the first cycle
+	Connections map[string]bool `json:"connections"`
 }
 
 // NewWorker creates a new polling worker
@@ -54,40 +80,65 @@ func (w *Worker) Initialize(ctx context.Context) error {
 	w.logEntry("info", "Watermark loaded")
 
 	// Initialize Akva client
-	w.akvaClient = akva.NewClient(cfg.SQLServer)
-	if err := w.akvaClient.Connect(ctx); err != nil {
+	akvaClient := akva.NewClient(cfg.SQLServer)
+	if err := akvaClient.Connect(ctx); err != nil {
 		w.logEntry("warn", "Failed to connect to SQL Server: "+err.Error())
 		// Don't fail - worker can try to reconnect later
 	} else {
 		w.logEntry("info", "Connected to SQL Server")
 	}
 
-	// Initialize MQTT client
-	w.mqttClient = mqtt.NewClient(cfg.MQTT)
-	if err := w.mqttClient.Connect(); err != nil {
-		w.logEntry("warn", "Failed to connect to MQTT: "+err.Error())
-	} else {
-		w.logEntry("info", "Connected to MQTT broker")
+	// Initialize MQTT clients, the primary broker first
+	var mqttClient *mqtt.Client
+	var brokers []*mqtt.Broker
+	for _, o := range cfg.MQTT.AllOutputs() {
+		client := mqtt.NewClient(o.MQTTConfig)
+		client.EnableStatus(func() interface{} { return w.heartbeatReport() })
+		if o.CommandsEnabled {
+			client.ServeCommands(w.runCommand)
+		}
+		// The broker's publisher subscribes too (Sparkplug NCMD), so it is created first
+		broker := mqtt.NewBroker(o.Name, client)
+		if err := client.Connect(); err != nil {
+			w.logEntry("warn", fmt.Sprintf("Failed to connect to MQTT output %s: %v", o.Name, err))
+		} else {
+			w.logEntry("info", fmt.Sprintf("Connected to MQTT broker (output %s)", o.Name))
+		}
+		if o.Name == config.PrimaryOutput {
+			mqttClient = client
+		}
+		brokers = append(brokers, broker)
 	}
-	w.mqttPub = mqtt.NewPublisher(w.mqttClient)
+	mqttOut := mqtt.NewBrokers(brokers)
 
 	// Initialize MongoDB client
-	w.mongoClient = mongo.NewClient(cfg.MongoDB)
-	if err := w.mongoClient.Connect(ctx); err != nil {
+	mongoClient := mongo.NewClient(cfg.MongoDB)
+	if err := mongoClient.Connect(ctx); err != nil {
 		w.logEntry("warn", "Failed to connect to MongoDB: "+err.Error())
 	} else {
 		w.logEntry("info", "Connected to MongoDB")
 	}
-	w.mongoRepo = mongo.NewRepository(w.mongoClient)
+	mongoRepo := mongo.NewRepository(mongoClient)
 
 	// Create poller
-	w.poller = NewPoller(cfg.Polling, w.akvaClient, w.mqttPub, w.mongoRepo, w.watermark)
+	poller := NewPoller(cfg.Polling, akvaClient, mqttOut, mongoRepo, w.watermark)
 
 	// Refresh stats from MongoDB (only if connected)
-	if w.mongoClient != nil && w.mongoClient.IsConnected() {
-		w.poller.RefreshStats(ctx)
+	if mongoClient.IsConnected() {
+		poller.RefreshStats(ctx)
 	}
 
+	// The admin server and the MQTT heartbeat read these while this runs
+	w.clientsMu.Lock()
+	w.akvaClient = akvaClient
+	w.mqttClient = mqttClient
+	w.mqttOut = mqttOut
+	w.mongoClient = mongoClient
+	w.mongoRepo = mongoRepo
+	w.auditRepo = mongo.NewAuditRepository(mongoClient)
+	w.poller = poller
+	w.clientsMu.Unlock()
+
 	return nil
 }
 
@@ -101,7 +152,7 @@ func (w *Worker) Start() error {
 	}
 
 	// Initialize if needed
-	if w.poller == nil {
+	if w.currentPoller() == nil {
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
 		if err := w.Initialize(ctx); err != nil {
@@ -215,18 +266,116 @@ func (w *Worker) run() {
 
 // doPoll executes a single poll cycle
 func (w *Worker) doPoll() {
+	w.pollMu.Lock()
+	defer w.pollMu.Unlock()
+
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
 
-	if err := w.poller.Poll(ctx); err != nil {
+	poller := w.currentPoller()
+	start := time.Now()
+	before := poller.GetStats().TotalEvents
+	err := poller.Poll(ctx)
+
+	result := &CycleResult{
+		At:         start.UTC(),
+		DurationMS: time.Since(start).Milliseconds(),
+		Events:     poller.GetStats().TotalEvents - before,
+	}
+	if err != nil {
+		result.Error = err.Error()
 		w.logEntry("error", "Poll error: "+err.Error())
 	}
+	w.cycleMu.Lock()
+	w.lastCycle = result
+	w.cycleMu.Unlock()
+}
+
+// PollNow runs a poll cycle at once, whether or not the worker is
+// running, and returns its result
+func (w *Worker) PollNow() (CycleResult, error) {
+	if w.currentPoller() == nil {
+		return CycleResult{}, fmt.Errorf("worker not initialized")
+	}
+	w.doPoll()
+	w.cycleMu.Lock()
+	defer w.cycleMu.Unlock()
+	return *w.lastCycle, nil
+}
+
+// Replay queues the events stored in MongoDB with fechaHora in
+// [from, to] for every MQTT output again, oldest first, and returns how
+// many were queued. The watermark is not changed.
+func (w *Worker) Replay(ctx context.Context, from, to time.Time) (int, error) {
+	repo, out := w.repository(), w.outputs()
+	if repo == nil || out == nil {
+		return 0, fmt.Errorf("worker not initialized")
+	}
+	evts, err := repo.EventsInRange(ctx, from, to, maxReplayEvents+1)
+	if err != nil {
+		return 0, err
+	}
+	if len(evts) > maxReplayEvents {
+		return 0, fmt.Errorf("range holds more than %d events, narrow it", maxReplayEvents)
+	}
+	if len(evts) == 0 {
+		return 0, nil
+	}
+
+	w.pollMu.Lock()
+	defer w.pollMu.Unlock()
+	if room := out.Room(); room < len(evts) {
+		return 0, fmt.Errorf("MQTT outbox has room for %d of the %d events, retry once it drains", room, len(evts))
+	}
+	if err := out.Enqueue(evts); err != nil {
+		return 0, err
+	}
+	w.logEntry("info", fmt.Sprintf("Queued %d events for replay, from %s to %s", len(evts), from.Format(time.RFC3339), to.Format(time.RFC3339)))
+	return len(evts), nil
+}
+
+// SetCommandHandler sets what runs the MQTT commands received when
+// mqtt.commandsEnabled is set
+func (w *Worker) SetCommandHandler(handler mqtt.CommandHandler) {
+	w.commandsMu.Lock()
+	defer w.commandsMu.Unlock()
+	w.commands = handler
+}
+
+// runCommand passes an MQTT command to the command handler. The
+// subscription is made at connect time, possibly before the admin
+// server has set a handler.
+func (w *Worker) runCommand(cmd mqtt.Command) mqtt.CommandReply {
+	w.commandsMu.RLock()
+	handler := w.commands
+	w.commandsMu.RUnlock()
+	if handler == nil {
+		return mqtt.CommandReply{Error: "commands are not available yet"}
+	}
+	return handler(cmd)
+}
+
+// heartbeatReport describes the worker for the MQTT status topic
+func (w *Worker) heartbeatReport() interface{} {
+	w.cycleMu.Lock()
+	last := w.lastCycle
+	w.cycleMu.Unlock()
+	return HeartbeatReport{
+		Running:     w.IsRunning(),
+		Watermark:   w.GetWatermark().LastFechaHora,
+		LastCycle:   last,
+		Connections: w.DependencyHealth(),
+	}
 }
 
 // checkAndReconnectSQL checks SQL connection and attempts to reconnect if needed
 func (w *Worker) checkAndReconnectSQL() {
+	w.clientsMu.RLock()
+	client := w.akvaClient
+	w.clientsMu.RUnlock()
+
 	// Check if SQL client exists and is connected
-	if w.akvaClient == nil || !w.akvaClient.IsConnected() {
+	if client == nil || !client.IsConnected() {
 		w.logEntry("warn", "SQL Server disconnected, attempting to reconnect...")
 		
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -235,18 +384,21 @@ func (w *Worker) checkAndReconnectSQL() {
 		cfg := w.configManager.Get()
 		
 		// Create new client if needed
-		if w.akvaClient == nil {
-			w.akvaClient = akva.NewClient(cfg.SQLServer)
+		if client == nil {
+			client = akva.NewClient(cfg.SQLServer)
+			w.clientsMu.Lock()
+			w.akvaClient = client
+			w.clientsMu.Unlock()
 		}
 		
 		// Attempt to connect
-		if err := w.akvaClient.Connect(ctx); err != nil {
+		if err := client.Connect(ctx); err != nil {
 			w.logEntry("warn", "SQL Server reconnection failed: "+err.Error())
 		} else {
 			w.logEntry("info", "✓ SQL Server reconnected successfully")
 			// Update poller with reconnected client
-			if w.poller != nil {
-				w.poller.akvaClient = w.akvaClient
+			if poller := w.currentPoller(); poller != nil {
+				poller.akvaClient = client
 			}
 		}
 	}
@@ -259,12 +411,71 @@ func (w *Worker) IsRunning() bool {
 	return w.running
 }
 
+// DependencyHealth checks each backend connection live, keyed by the
+// same names used in the status API ("sqlServer", "mqtt", "mongodb")
+func (w *Worker) DependencyHealth() map[string]bool {
+	w.clientsMu.RLock()
+	akvaClient, mqttClient, mongoClient := w.akvaClient, w.mqttClient, w.mongoClient
+	w.clientsMu.RUnlock()
+	return map[string]bool{
+		"sqlServer": akvaClient != nil && akvaClient.IsConnected(),
+		"mqtt":      mqttClient != nil && mqttClient.IsConnectionOpen(),
+		"mongodb":   mongoClient != nil && mongoClient.IsConnected(),
+	}
+}
+
+// MQTTBrokers reports each MQTT output and its outbox, primary first
+func (w *Worker) MQTTBrokers() []mqtt.BrokerStatus {
+	out := w.outputs()
+	if out == nil {
+		return nil
+	}
+	return out.Status()
+}
+
+// currentPoller returns the poller, nil before Initialize has run
+func (w *Worker) currentPoller() *Poller {
+	w.clientsMu.RLock()
+	defer w.clientsMu.RUnlock()
+	return w.poller
+}
+
+// outputs returns the MQTT outputs, nil before Initialize has run
+func (w *Worker) outputs() *mqtt.Brokers {
+	w.clientsMu.RLock()
+	defer w.clientsMu.RUnlock()
+	return w.mqttOut
+}
+
+// repository returns the events repository, nil before Initialize has run
+func (w *Worker) repository() *mongo.Repository {
+	w.clientsMu.RLock()
+	defer w.clientsMu.RUnlock()
+	return w.mongoRepo
+}
+
+// audits returns the audit repository, nil before Initialize has run
+func (w *Worker) audits() *mongo.AuditRepository {
+	w.clientsMu.RLock()
+	defer w.clientsMu.RUnlock()
+	return w.auditRepo
+}
+
+// GetWatermark returns the current watermark
+func (w *Worker) GetWatermark() Watermark {
+	if w.watermark == nil {
+		return Watermark{}
+	}
+	return w.watermark.Get()
+}
+
 // GetStats returns worker statistics
 func (w *Worker) GetStats() Stats {
-	if w.poller == nil {
+	poller := w.currentPoller()
+	if poller == nil {
 		return Stats{}
 	}
-	return w.poller.GetStats()
+	return poller.GetStats()
 }
 
 // ResetWatermark resets the watermark
@@ -315,6 +526,15 @@ func (w *Worker) TestMongoConnection() (bool, error) {
 	return true, nil
 }
 
+// ClearJaulaState removes the retained MQTT state of a decommissioned jaula
+func (w *Worker) ClearJaulaState(centro, jaula string) error {
+	out := w.outputs()
+	if out == nil {
+		return fmt.Errorf("mqtt not connected")
+	}
+	return out.ClearState(centro, jaula)
+}
+
 // GetLogs returns recent log entries
 func (w *Worker) GetLogs() []events.LogEntry {
 	w.logsMu.Lock()
@@ -324,50 +544,74 @@ func (w *Worker) GetLogs() []events.LogEntry {
 
 // GetRecentEvents returns recent events from MongoDB
 func (w *Worker) GetRecentEvents(ctx context.Context, limit int) ([]mongo.HistoricalEvent, error) {
-	if w.mongoRepo == nil {
+	repo := w.repository()
+	if repo == nil {
 		return []mongo.HistoricalEvent{}, nil
 	}
-	return w.mongoRepo.GetRecentEvents(ctx, limit)
+	return repo.GetRecentEvents(ctx, limit)
 }
 
 // QueryEvents queries events with filtering and pagination
 func (w *Worker) QueryEvents(ctx context.Context, opts mongo.QueryOptions) (*mongo.QueryResult, error) {
-	if w.mongoRepo == nil {
+	repo := w.repository()
+	if repo == nil {
 		return nil, fmt.Errorf("mongodb not connected")
 	}
-	return w.mongoRepo.QueryEvents(ctx, opts)
+	return repo.QueryEvents(ctx, opts)
 }
 
 // GetEventByID retrieves a single event by ID
 func (w *Worker) GetEventByID(ctx context.Context, id string) (*mongo.HistoricalEvent, error) {
-	if w.mongoRepo == nil {
+	repo := w.repository()
+	if repo == nil {
 		return nil, fmt.Errorf("mongodb not connected")
 	}
-	return w.mongoRepo.GetByID(ctx, id)
+	return repo.GetByID(ctx, id)
 }
 
 // UpdateEvent updates an event
 func (w *Worker) UpdateEvent(ctx context.Context, id string, update map[string]interface{}) error {
-	if w.mongoRepo == nil {
+	repo := w.repository()
+	if repo == nil {
 		return fmt.Errorf("mongodb not connected")
 	}
-	return w.mongoRepo.UpdateByID(ctx, id, update)
+	return repo.UpdateByID(ctx, id, update)
 }
 
 // DeleteEvent deletes an event
 func (w *Worker) DeleteEvent(ctx context.Context, id string) error {
-	if w.mongoRepo == nil {
+	repo := w.repository()
+	if repo == nil {
 		return fmt.Errorf("mongodb not connected")
 	}
-	return w.mongoRepo.DeleteByID(ctx, id)
+	return repo.DeleteByID(ctx, id)
 }
 
 // DeleteEventsBatch deletes multiple events matching criteria
 func (w *Worker) DeleteEventsBatch(ctx context.Context, source string, beforeDate *time.Time) (int64, error) {
-	if w.mongoRepo == nil {
+	repo := w.repository()
+	if repo == nil {
 		return 0, fmt.Errorf("mongodb not connected")
 	}
-	return w.mongoRepo.DeleteByFilter(ctx, source, beforeDate)
+	return repo.DeleteByFilter(ctx, source, beforeDate)
+}
+
+// RecordAudit stores an entry in the audit trail
+func (w *Worker) RecordAudit(ctx context.Context, entry mongo.AuditEntry) error {
+	repo := w.audits()
+	if repo == nil {
+		return fmt.Errorf("mongodb not connected")
+	}
+	return repo.Insert(ctx, entry)
+}
+
+// QueryAudit queries the audit trail with filtering and pagination
+func (w *Worker) QueryAudit(ctx context.Context, opts mongo.AuditQueryOptions) (*mongo.AuditQueryResult, error) {
+	repo := w.audits()
+	if repo == nil {
+		return nil, fmt.Errorf("mongodb not connected")
+	}
+	return repo.Query(ctx, opts)
 }
 
 // logEntry adds a log entry
@@ -393,13 +637,16 @@ func (w *Worker) logEntry(level, message string) {
 func (w *Worker) Shutdown(ctx context.Context) {
 	w.Stop()
 
-	if w.akvaClient != nil {
-		w.akvaClient.Close()
+	w.clientsMu.RLock()
+	akvaClient, mqttOut, mongoClient := w.akvaClient, w.mqttOut, w.mongoClient
+	w.clientsMu.RUnlock()
+	if akvaClient != nil {
+		akvaClient.Close()
 	}
-	if w.mqttClient != nil {
-		w.mqttClient.Disconnect()
+	if mqttOut != nil {
+		mqttOut.Close(ctx)
 	}
-	if w.mongoClient != nil {
-		w.mongoClient.Disconnect(ctx)
+	if mongoClient != nil {
+		mongoClient.Disconnect(ctx)
 	}
 }
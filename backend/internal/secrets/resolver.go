@@ -0,0 +1,97 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// LiteralPrefix escapes a literal value that would otherwise read as a
+// reference: "literal:file:abc" is the password "file:abc"
+const LiteralPrefix = "literal:"
+
+// Provider resolves the part of a secret reference after "<scheme>:"
+type Provider interface {
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+// Resolver dispatches secret references such as "env:MQTT_PASSWORD",
+// "file:/run/secrets/mqtt" or "vault:secret/data/omnipoll#mqttPassword"
+// to the provider registered for their scheme
+type Resolver struct {
+	providers map[string]Provider
+}
+
+// NewResolver creates a resolver with the env, file and vault providers.
+// The vault provider reads VAULT_ADDR and VAULT_TOKEN from the environment.
+func NewResolver() *Resolver {
+	return &Resolver{
+		providers: map[string]Provider{
+			"env":   EnvProvider{},
+			"file":  FileProvider{},
+			"vault": NewVaultProviderFromEnv(),
+		},
+	}
+}
+
+// Register adds or replaces the provider for scheme
+func (r *Resolver) Register(scheme string, p Provider) {
+	r.providers[scheme] = p
+}
+
+// IsReference reports whether value is a secret reference rather than a literal
+func IsReference(value string) bool {
+	scheme, rest, ok := strings.Cut(value, ":")
+	if !ok || rest == "" {
+		return false
+	}
+	switch scheme {
+	case "env", "file", "vault":
+		return true
+	}
+	return false
+}
+
+// Literal returns value without LiteralPrefix, and whether it was escaped
+func Literal(value string) (string, bool) {
+	return strings.CutPrefix(value, LiteralPrefix)
+}
+
+// Resolve returns the secret a reference points to
+func (r *Resolver) Resolve(ctx context.Context, value string) (string, error) {
+	scheme, ref, ok := strings.Cut(value, ":")
+	if !ok {
+		return "", fmt.Errorf("invalid secret reference %q", value)
+	}
+	p, ok := r.providers[scheme]
+	if !ok {
+		return "", fmt.Errorf("no secret provider for scheme %q", scheme)
+	}
+	return p.Resolve(ctx, ref)
+}
+
+// EnvProvider reads secrets from environment variables ("env:VAR")
+type EnvProvider struct{}
+
+// Resolve returns the value of the environment variable
+func (EnvProvider) Resolve(_ context.Context, name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+// FileProvider reads secrets from files ("file:/run/secrets/x"), as
+// mounted by Docker and Kubernetes secrets
+type FileProvider struct{}
+
+// Resolve returns the file contents without the trailing newline
+func (FileProvider) Resolve(_ context.Context, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
@@ -0,0 +1,96 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	VaultAddrEnv      = "VAULT_ADDR"
+	VaultTokenEnv     = "VAULT_TOKEN"
+	VaultNamespaceEnv = "VAULT_NAMESPACE"
+)
+
+// VaultProvider reads secrets from a HashiCorp Vault KV engine.
+//
+// References have the form "vault:<api path>#<field>", for example
+// "vault:secret/data/omnipoll#mqttPassword" for a KV v2 mount named
+// "secret". KV v1 paths ("vault:kv/omnipoll#mqttPassword") work as well.
+type VaultProvider struct {
+	Addr      string
+	Token     string
+	Namespace string
+	client    *http.Client
+}
+
+// NewVaultProviderFromEnv configures a provider from the standard Vault variables
+func NewVaultProviderFromEnv() *VaultProvider {
+	return &VaultProvider{
+		Addr:      os.Getenv(VaultAddrEnv),
+		Token:     os.Getenv(VaultTokenEnv),
+		Namespace: os.Getenv(VaultNamespaceEnv),
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Resolve fetches the secret and returns the requested field
+func (p *VaultProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	if p.Addr == "" || p.Token == "" {
+		return "", fmt.Errorf("vault reference used but %s/%s are not set", VaultAddrEnv, VaultTokenEnv)
+	}
+
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok || path == "" || field == "" {
+		return "", fmt.Errorf("invalid vault reference %q (expected <path>#<field>)", ref)
+	}
+
+	url := strings.TrimRight(p.Addr, "/") + "/v1/" + strings.TrimLeft(path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", p.Token)
+	if p.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.Namespace)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("vault request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %s for %s", resp.Status, path)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("invalid vault response: %w", err)
+	}
+
+	// KV v2 nests the secret under data.data
+	data := body.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, hasMeta := data["metadata"]; hasMeta {
+			data = nested
+		}
+	}
+
+	value, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("field %q not found in vault secret %s", field, path)
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("field %q in vault secret %s is not a string", field, path)
+	}
+	return s, nil
+}
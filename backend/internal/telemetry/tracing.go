@@ -0,0 +1,116 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/omnipoll/backend/internal/config"
+)
+
+const instrumentationName = "github.com/omnipoll/backend"
+
+// ShutdownFunc flushes pending spans and releases the exporter
+type ShutdownFunc func(ctx context.Context) error
+
+// Setup installs the global tracer provider described by cfg.
+// When tracing is disabled the global no-op provider is left in place,
+// so spans created through Tracer() cost nothing.
+func Setup(ctx context.Context, cfg config.TracingConfig) (ShutdownFunc, error) {
+	noop := func(context.Context) error { return nil }
+	if !cfg.Enabled {
+		return noop, nil
+	}
+
+	exporter, err := newExporter(ctx, cfg)
+	if err != nil {
+		return noop, err
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "omnipoll"
+	}
+
+	res, err := resource.Merge(
+		resource.Default(),
+		resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName)),
+	)
+	if err != nil {
+		return noop, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+
+	// Unset samples everything; 0 samples nothing, as in OpenTelemetry
+	sampler := sdktrace.AlwaysSample()
+	if r := cfg.SampleRatio; r != nil && *r < 1 {
+		sampler = sdktrace.TraceIDRatioBased(*r)
+		if *r <= 0 {
+			sampler = sdktrace.NeverSample()
+		}
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	return provider.Shutdown, nil
+}
+
+// newExporter creates the span exporter selected in the config
+func newExporter(ctx context.Context, cfg config.TracingConfig) (sdktrace.SpanExporter, error) {
+	switch cfg.Exporter {
+	case "", "otlp":
+		opts := []otlptracehttp.Option{}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err := otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+		}
+		return exporter, nil
+	case "stdout":
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stdout exporter: %w", err)
+		}
+		return exporter, nil
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q (expected \"otlp\" or \"stdout\")", cfg.Exporter)
+	}
+}
+
+// Tracer returns the application tracer from the global provider
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// RecordError marks the span as failed with err (no-op when err is nil)
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
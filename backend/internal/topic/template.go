@@ -0,0 +1,215 @@
+// Package topic renders MQTT topics from templates such as
+// "farm/{centro|slug}/{jaula|digits}/feeding".
+package topic
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/omnipoll/backend/internal/events"
+)
+
+// fields are the event placeholders a template can use; "prefix" and
+// "encoding" come from Vars
+var fields = map[string]func(e events.NormalizedEvent) string{
+	"centro":      func(e events.NormalizedEvent) string { return e.Name },
+	"jaula":       func(e events.NormalizedEvent) string { return e.UnitName },
+	"silo":        func(e events.NormalizedEvent) string { return e.SiloName },
+	"dosificador": func(e events.NormalizedEvent) string { return e.DoserName },
+	"alimento":    func(e events.NormalizedEvent) string { return e.FeedName },
+	"dia":         func(e events.NormalizedEvent) string { return e.Dia },
+	"source":      func(e events.NormalizedEvent) string { return e.Source },
+	"id":          func(e events.NormalizedEvent) string { return e.ID },
+}
+
+const (
+	prefixField   = "prefix"
+	encodingField = "encoding"
+)
+
+// Vars are the placeholder values that do not come from the event
+type Vars struct {
+	Prefix   string // mqtt.topicPrefix, may span several levels
+	Encoding string // Payload encoding, e.g. "json" or "cbor"
+}
+
+var (
+	nonAlnum  = regexp.MustCompile(`[^a-z0-9]+`)
+	nonDigits = regexp.MustCompile(`[^0-9]`)
+	accents   = strings.NewReplacer("á", "a", "é", "e", "í", "i", "ó", "o", "ú", "u", "ü", "u", "ñ", "n",
+		"Á", "A", "É", "E", "Í", "I", "Ó", "O", "Ú", "U", "Ü", "U", "Ñ", "N")
+
+	// sanitize keeps an event value inside one level
+	sanitize = strings.NewReplacer("/", "-", "+", "-", "#", "-", "\x00", "").Replace
+)
+
+// funcs are the normalization functions, applied left to right
+var funcs = map[string]func(string) string{
+	"lower":  strings.ToLower,
+	"upper":  strings.ToUpper,
+	"slug":   func(s string) string { return separate(s, "-") },
+	"snake":  func(s string) string { return separate(s, "_") },
+	"digits": func(s string) string { return nonDigits.ReplaceAllString(s, "") },
+}
+
+// separate lowercases s, folds accents and joins the alphanumeric runs with sep
+func separate(s, sep string) string {
+	s = strings.ToLower(accents.Replace(s))
+	return strings.Trim(nonAlnum.ReplaceAllString(s, sep), sep)
+}
+
+// Template is a parsed topic template
+type Template struct {
+	raw   string
+	parts []part
+}
+
+// part is a literal or a {field|func|...} placeholder
+type part struct {
+	literal string
+	field   string
+	funcs   []func(string) string
+}
+
+// Parse parses and validates a template. Literals may not contain the
+// wildcards + or #, and no level may be empty.
+func Parse(tmpl string) (*Template, error) {
+	if strings.TrimSpace(tmpl) == "" {
+		return nil, fmt.Errorf("template is empty")
+	}
+
+	t := &Template{raw: tmpl}
+	var shape strings.Builder // The template with placeholders as "x", to check its levels
+	rest := tmpl
+	for rest != "" {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			t.parts = append(t.parts, part{literal: rest})
+			shape.WriteString(rest)
+			break
+		}
+		if rest[open] == '}' {
+			return nil, fmt.Errorf("unexpected } at position %d", len(tmpl)-len(rest)+open)
+		}
+		if open > 0 {
+			t.parts = append(t.parts, part{literal: rest[:open]})
+			shape.WriteString(rest[:open])
+		}
+		end := strings.IndexAny(rest[open+1:], "{}")
+		if end < 0 || rest[open+1+end] != '}' {
+			return nil, fmt.Errorf("unclosed { at position %d", len(tmpl)-len(rest)+open)
+		}
+		p, err := parsePlaceholder(rest[open+1 : open+1+end])
+		if err != nil {
+			return nil, err
+		}
+		t.parts = append(t.parts, p)
+		shape.WriteString("x")
+		rest = rest[open+2+end:]
+	}
+
+	if strings.ContainsAny(shape.String(), "+#") {
+		return nil, fmt.Errorf("template must not contain the wildcards + or #")
+	}
+	for _, level := range strings.Split(shape.String(), "/") {
+		if level == "" {
+			return nil, fmt.Errorf("template must not have empty levels (leading, trailing or double /)")
+		}
+	}
+	return t, nil
+}
+
+// parsePlaceholder parses the inside of {field|func|...}
+func parsePlaceholder(s string) (part, error) {
+	names := strings.Split(s, "|")
+	p := part{field: strings.TrimSpace(names[0])}
+	if _, ok := fields[p.field]; !ok && p.field != prefixField && p.field != encodingField {
+		return part{}, fmt.Errorf("unknown field {%s} (expected one of %s)", p.field, strings.Join(FieldNames(), ", "))
+	}
+	for _, name := range names[1:] {
+		fn, ok := funcs[strings.TrimSpace(name)]
+		if !ok {
+			return part{}, fmt.Errorf("unknown function %q in {%s} (expected one of %s)", strings.TrimSpace(name), s, strings.Join(FuncNames(), ", "))
+		}
+		p.funcs = append(p.funcs, fn)
+	}
+	return p, nil
+}
+
+// Render returns the topic of an event. Wildcards and slashes in event
+// values are replaced, so a value never adds levels; a level that still
+// renders empty is an error.
+func (t *Template) Render(e events.NormalizedEvent, vars Vars) (string, error) {
+	var b strings.Builder
+	for _, p := range t.parts {
+		switch {
+		case p.field == "":
+			b.WriteString(p.literal)
+		case p.field == prefixField:
+			b.WriteString(strings.Trim(apply(p.funcs, vars.Prefix), "/"))
+		case p.field == encodingField:
+			b.WriteString(sanitize(apply(p.funcs, vars.Encoding)))
+		default:
+			b.WriteString(sanitize(apply(p.funcs, fields[p.field](e))))
+		}
+	}
+
+	topic := b.String()
+	for _, level := range strings.Split(topic, "/") {
+		if strings.TrimSpace(level) == "" {
+			return "", fmt.Errorf("topic %q has an empty level", topic)
+		}
+	}
+	return topic, nil
+}
+
+// String returns the template source
+func (t *Template) String() string {
+	return t.raw
+}
+
+// Fields returns the placeholders the template uses, in order
+func (t *Template) Fields() []string {
+	var names []string
+	for _, p := range t.parts {
+		if p.field != "" {
+			names = append(names, p.field)
+		}
+	}
+	return names
+}
+
+func apply(fns []func(string) string, value string) string {
+	for _, fn := range fns {
+		value = fn(value)
+	}
+	return value
+}
+
+// FieldNames lists the placeholders a template can use
+func FieldNames() []string {
+	names := []string{prefixField, encodingField}
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Func returns the normalization function called name
+func Func(name string) (func(string) string, bool) {
+	fn, ok := funcs[name]
+	return fn, ok
+}
+
+// FuncNames lists the normalization functions
+func FuncNames() []string {
+	names := make([]string, 0, len(funcs))
+	for name := range funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}